@@ -0,0 +1,281 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gorilla/websocket"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 后端策略, 按目标地址匹配, 第一条命中的生效
+//
+//	"backends": [
+//	  {"match": ["10.0.0.0/8", "game.local:9000"], "proxy_protocol": 2,
+//	   "pp_tlvs": {"session_id": true, "authority": true}}
+//	]
+type BackendConf struct {
+	Match         []string        `json:"match"`
+	ProxyProtocol *int            `json:"proxy_protocol"` //0关闭, 1/2为版本号, 不配置时沿用 -proxyproto
+	PPTLVs        *PPTLVConf      `json:"pp_tlvs"`        //v2 附带的TLV
+	WSURL         string          `json:"ws_url"`         //websocket 后端地址模板, 如 "wss://{addr}/socket.io/?EIO=4"
+	TLS           *BackendTLSConf `json:"tls"`            //wss 后端的 TLS 设置
+
+	matchers  []func(host, port string) bool
+	tlsConfig *tls.Config
+}
+
+// wss 后端的 TLS 设置
+type BackendTLSConf struct {
+	CA                 string `json:"ca"`                   //CA证书文件, 为空时使用系统证书
+	ServerName         string `json:"server_name"`          //SNI 及证书校验使用的主机名
+	Cert               string `json:"cert"`                 //客户端证书
+	Key                string `json:"key"`                  //客户端证书私钥
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` //不校验后端证书
+}
+
+// proxy-protocol v2 TLV 选项
+type PPTLVConf struct {
+	SessionID bool              `json:"session_id"` //PP2_TYPE_UNIQUE_ID
+	Authority bool              `json:"authority"`  //PP2_TYPE_AUTHORITY, 取 SNI 或 Host
+	SSL       bool              `json:"ssl"`        //PP2_TYPE_SSL, 仅 wss 接入时
+	Custom    map[string]string `json:"custom"`     //自定义TLV, 类型范围 0xE0-0xEF, 如 {"0xE0": "game"}
+
+	custom []customTLV
+}
+
+type customTLV struct {
+	typ   byte
+	value []byte
+}
+
+// 未命中任何配置时使用的默认策略
+var defaultBackend = &BackendConf{}
+
+func (b *BackendConf) compile() error {
+	b.matchers = nil
+	for _, m := range b.Match {
+		f, err := hostMatcher(m)
+		if err != nil {
+			return err
+		}
+		b.matchers = append(b.matchers, f)
+	}
+
+	if b.ProxyProtocol != nil {
+		if v := *b.ProxyProtocol; v < 0 || v > 2 {
+			return fmt.Errorf("proxy_protocol: unknown version %d", v)
+		}
+	}
+
+	if b.WSURL != "" {
+		u, err := url.Parse(strings.Replace(b.WSURL, "{addr}", "localhost", -1))
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			return fmt.Errorf("ws_url: '%s' must be a ws:// or wss:// URL", b.WSURL)
+		}
+	}
+
+	if t := b.TLS; t != nil {
+		c, err := t.config()
+		if err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+		b.tlsConfig = c
+	}
+
+	if t := b.PPTLVs; t != nil {
+		t.custom = nil
+		for k, v := range t.Custom {
+			var typ uint
+			if _, err := fmt.Sscanf(k, "0x%x", &typ); err != nil || typ < 0xE0 || typ > 0xEF {
+				return fmt.Errorf("pp_tlvs: custom type '%s' must be 0xE0-0xEF", k)
+			}
+			t.custom = append(t.custom, customTLV{byte(typ), []byte(v)})
+		}
+	}
+	return nil
+}
+
+// 地址匹配规则
+//
+//	"*"               任意地址
+//	"10.0.0.0/8"      网段
+//	"10.0.0.1"        主机, 任意端口
+//	"game.local:9000" 主机+端口
+func hostMatcher(m string) (func(host, port string) bool, error) {
+	m = strings.TrimSpace(m)
+	if m == "*" {
+		return func(host, port string) bool { return true }, nil
+	}
+	if strings.Contains(m, "/") {
+		_, ipnet, err := net.ParseCIDR(m)
+		if err != nil {
+			return nil, fmt.Errorf("match: %s", err)
+		}
+		return func(host, port string) bool {
+			ip := net.ParseIP(host)
+			return ip != nil && ipnet.Contains(ip)
+		}, nil
+	}
+	if h, p, err := net.SplitHostPort(m); err == nil {
+		return func(host, port string) bool {
+			return strings.EqualFold(host, h) && port == p
+		}, nil
+	}
+	return func(host, port string) bool {
+		return strings.EqualFold(host, strings.Trim(m, "[]"))
+	}, nil
+}
+
+// 解析地址段列表, 单个IP视为 /32 或 /128
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range list {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", c)
+			}
+			bits := If(ip.To4() != nil, 32, 128).(int)
+			nets = append(nets, &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, bits)), Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// net.Addr 中的IP
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if a == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (b *BackendConf) matches(raddr string) bool {
+	host, port, err := net.SplitHostPort(raddr)
+	if err != nil {
+		host = raddr
+	}
+	for _, f := range b.matchers {
+		if f(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 查找后端策略
+func findBackend(raddr string) *BackendConf {
+	for _, b := range cfg.Backends {
+		if b.matches(raddr) {
+			return b
+		}
+	}
+	return defaultBackend
+}
+
+// 该后端使用的 proxy-protocol 版本, 0 表示不发送
+func (b *BackendConf) ppVersion() int {
+	if b.ProxyProtocol != nil {
+		return *b.ProxyProtocol
+	}
+	if PProto {
+		return int(cfgPPVersion)
+	}
+	return 0
+}
+
+func (t *BackendTLSConf) config() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", t.CA)
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// websocket 后端的完整地址
+// token 中指定了 url 时直接使用, 否则按 ws_url 模板, 默认 ws://{addr}/
+func (b *BackendConf) wsURL(tk *tokenInfo) string {
+	if tk.URL != "" {
+		return tk.URL
+	}
+	if b.WSURL != "" {
+		return strings.Replace(b.WSURL, "{addr}", tk.Addr, -1)
+	}
+	return "ws://" + tk.Addr + "/"
+}
+
+// 连接 websocket 后端的 Dialer, 握手与拨号都受 -timeout 限制
+func (b *BackendConf) wsDialer(dc *DialConf) *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dc.dialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &meteredConn{Conn: c}, nil
+		},
+		TLSClientConfig:  b.tlsConfig,
+		HandshakeTimeout: time.Duration(cfgDialTimeout),
+		ReadBufferSize:   int(cfgBufferSize),
+		WriteBufferSize:  int(cfgBufferSize),
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ************************************************************
+// 证书目录, 按 SNI 选择证书
+//
+// 目录 (及其一级子目录) 中的 name.crt/name.pem 与同名的 .key 为一对,
+// 兼容 cert-manager 等工具挂载的 tls.crt/tls.key; 没有 .key 时从证书文件中读取私钥。
+// 按证书中的 DNS 名称 (含通配符) 匹配 SNI, 不看文件名。
+// 每隔 certDirPoll 检查一次文件变化, 有变化时整体重新加载。
+// ************************************************************
+
+const certDirPoll = 10 * time.Second
+
+type certDir struct {
+	dir string
+
+	sync.RWMutex
+	names map[string]*tls.Certificate
+	first *tls.Certificate //没有 SNI 时使用
+	sig   string           //文件名、大小、修改时间, 用于判断是否变化
+}
+
+func newCertDir(dir string) (*certDir, error) {
+	d := &certDir{dir: dir}
+	if _, err := d.reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *certDir) certFiles() ([]string, string, error) {
+	var files []string
+	var sig strings.Builder
+	for _, pattern := range []string{"*", "*/*"} {
+		matches, err := filepath.Glob(filepath.Join(d.dir, pattern))
+		if err != nil {
+			return nil, "", err
+		}
+		for _, f := range matches {
+			fi, err := os.Stat(f)
+			if err != nil || fi.IsDir() {
+				continue
+			}
+			// k8s secret 挂载中的 ..data 等隐藏目录
+			if strings.Contains(f, string(filepath.Separator)+"..") {
+				continue
+			}
+			fmt.Fprintf(&sig, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+			if ext := filepath.Ext(f); ext == ".crt" || ext == ".pem" {
+				files = append(files, f)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, sig.String(), nil
+}
+
+// 文件有变化时重新加载, 返回是否重新加载
+func (d *certDir) reload() (bool, error) {
+	files, sig, err := d.certFiles()
+	if err != nil {
+		return false, err
+	}
+	d.RLock()
+	same := sig == d.sig
+	d.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	names := make(map[string]*tls.Certificate)
+	var first *tls.Certificate
+	for _, f := range files {
+		key := strings.TrimSuffix(f, filepath.Ext(f)) + ".key"
+		if _, err := os.Stat(key); err != nil {
+			key = f
+		}
+		c, err := tls.LoadX509KeyPair(f, key)
+		if err != nil {
+			// 可能是 CA 证书或正在写入的文件
+			logger.Warningf("cert_dir: skip %s: %s", f, err)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			continue
+		}
+		c.Leaf = leaf
+
+		hosts := leaf.DNSNames
+		if len(hosts) == 0 && leaf.Subject.CommonName != "" {
+			hosts = []string{leaf.Subject.CommonName}
+		}
+		for _, h := range hosts {
+			names[strings.ToLower(h)] = &c
+		}
+		if first == nil {
+			first = &c
+		}
+	}
+
+	d.Lock()
+	d.names, d.first, d.sig = names, first, sig
+	d.Unlock()
+	return true, nil
+}
+
+func (d *certDir) get(name string) *tls.Certificate {
+	d.RLock()
+	defer d.RUnlock()
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return d.first
+	}
+	if c, ok := d.names[name]; ok {
+		return c
+	}
+	// 通配符只匹配一级子域名
+	if i := strings.Index(name, "."); i > 0 {
+		if c, ok := d.names["*"+name[i:]]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+func (d *certDir) watch() {
+	for range time.Tick(certDirPoll) {
+		changed, err := d.reload()
+		if err != nil {
+			logger.Errorf("cert_dir %s: %s", d.dir, err)
+		} else if changed {
+			d.RLock()
+			n := len(d.names)
+			d.RUnlock()
+			logger.Infof("cert_dir %s reloaded, %d names", d.dir, n)
+		}
+	}
+}
+
+// ************************************************************
+// 开发用自签名证书
+//
+// 包含 localhost、本机主机名、127.0.0.1 与 ::1, 有效期30天,
+// 缓存在用户缓存目录中, 重启后继续使用, 快过期时重新生成。
+// 只用于开发测试, 客户端需要手动信任或跳过校验。
+// ************************************************************
+func devCertificate() (*tls.Certificate, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "wsproxy")
+	certFile, keyFile := filepath.Join(dir, "dev-cert.pem"), filepath.Join(dir, "dev-key.pem")
+
+	if c, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(c.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > 24*time.Hour {
+			c.Leaf = leaf
+			return &c, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "wsproxy development certificate"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if h, err := os.Hostname(); err == nil && h != "localhost" {
+		tpl.DNSNames = append(tpl.DNSNames, h)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// 缓存失败不影响使用
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err == nil {
+			os.WriteFile(certFile, certPEM, 0644)
+		}
+	}
+
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
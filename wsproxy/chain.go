@@ -0,0 +1,372 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"proxyproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ************************************************************
+// 网关级联: 边缘网关经 wss 转发到内网网关, 可以有多跳
+//
+//	"chain": {"secret": "shared-key", "id": "edge-1", "max_hops": 8, "ttl": 30, "client_ip": "header"},
+//	"routes": [
+//	  {"path": "/", "proto": "tcp", "next_hop": "wss://inner.example.com/"}
+//	]
+//
+//	secret:    各跳共享的 HMAC-SHA256 密钥
+//	id:        本网关标识, 用于环路检测, 默认为进程的 UUID
+//	max_hops:  最多经过的网关数, 超过时拒绝, 默认 8
+//	ttl:       内层 token 的有效期 (秒), 默认 30
+//	client_ip: 客户端地址传给下一跳的方式
+//	           header (默认): X-Wsproxy-Client 头部, 计入签名
+//	           proxy_protocol: 连接下一跳时发送 PROXY v2 头, 会话ID在 UNIQUE_ID TLV 中,
+//	                           下一跳须以 accept_proxy_protocol 信任本网关;
+//	                           经由上游代理连接下一跳时不发送
+//
+// 配置了 next_hop 的路由不直接连接后端, 而是把客户端 token 解出的目标
+// (addr/url/claims) 放进签名的内层 token, 连接下一跳网关的同类路由。
+// 下一跳验证签名后直接使用其中的目标, 不再解密 token, 仍受后端组与虚拟主机限制;
+// 下一跳的路由 token 为 none 时忽略其中的目标, 从组内选择。
+// 内层 token 只能使用一次, 有效期内重复出现时拒绝 (每次连接下一跳都重新生成);
+// 只在接收的进程内记录, 下一跳有多个副本时不能发现发往其他副本的重放。
+// 每一跳增加 X-Wsproxy-Hops 并在 X-Wsproxy-Via 末尾加上自己的 id,
+// 收到的 Via 中已有自己的 id 或跳数超过 max_hops 时以 chain_loop 拒绝。
+// 各跳使用同一个会话ID, 日志可以按 Session-Id 串联。
+// ************************************************************
+type ChainConf struct {
+	Secret   string `json:"secret"`
+	ID       string `json:"id"`
+	MaxHops  int    `json:"max_hops"`
+	TTL      int    `json:"ttl"`
+	ClientIP string `json:"client_ip"`
+}
+
+const (
+	chainClientHeader = "header"
+	chainClientPP     = "proxy_protocol"
+
+	chainTokenPrefix = "wsc1."
+
+	chainHopsHeader = "X-Wsproxy-Hops"
+	chainViaHeader  = "X-Wsproxy-Via"
+	chainAddrHeader = "X-Wsproxy-Client"
+)
+
+var (
+	errChainSignature = errors.New("bad signature")
+	errChainLoop      = errors.New("gateway loop")
+)
+
+func (cc *ChainConf) compile() error {
+	if cc.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if cc.MaxHops < 0 || cc.TTL < 0 {
+		return fmt.Errorf("max_hops/ttl must not be negative")
+	}
+	if cc.ID == "" {
+		cc.ID = serverUUID
+	}
+	if strings.ContainsAny(cc.ID, ", \t\r\n") {
+		return fmt.Errorf("id must not contain spaces or ','")
+	}
+	if cc.MaxHops == 0 {
+		cc.MaxHops = 8
+	}
+	if cc.TTL == 0 {
+		cc.TTL = 30
+	}
+	switch cc.ClientIP {
+	case "":
+		cc.ClientIP = chainClientHeader
+	case chainClientHeader, chainClientPP:
+	default:
+		return fmt.Errorf("unknown client_ip '%s'", cc.ClientIP)
+	}
+	return nil
+}
+
+// 内层 token 的内容, 跳数、Via 与客户端地址在头部中, 一起签名
+type chainClaims struct {
+	Addr   string            `json:"addr"`
+	URL    string            `json:"url,omitempty"`
+	Claims map[string]string `json:"claims,omitempty"`
+	SID    string            `json:"sid"`
+	Exp    int64             `json:"exp"`
+	Nonce  string            `json:"nonce"`
+}
+
+// 已使用的内层 token, 在有效期内只接受一次
+// token 在 URL 中, 可能出现在中间设备的日志里, 重放会冒用同一个会话ID
+//
+// 按过期时间 (秒) 分桶, 过期时间在签名内, 同一个 token 总是落在同一个桶;
+// 每秒最多清理一次, 整桶删除已过期的, 不逐个扫描。
+// 只记录在本进程内: 下一跳有多个副本时, 发往另一个副本的重放不能发现。
+var chainSeen = struct {
+	sync.Mutex
+	buckets map[int64]map[string]struct{}
+	swept   int64
+}{buckets: make(map[int64]map[string]struct{})}
+
+// 记下一个 token, 已经用过时返回 false
+func chainOnce(sig string, exp int64) bool {
+	chainSeen.Lock()
+	defer chainSeen.Unlock()
+	if now := time.Now().Unix(); now != chainSeen.swept {
+		chainSeen.swept = now
+		for e := range chainSeen.buckets {
+			if now > e {
+				delete(chainSeen.buckets, e)
+			}
+		}
+	}
+	b := chainSeen.buckets[exp]
+	if b == nil {
+		b = make(map[string]struct{})
+		chainSeen.buckets[exp] = b
+	}
+	if _, ok := b[sig]; ok {
+		return false
+	}
+	b[sig] = struct{}{}
+	return true
+}
+
+func (cc *ChainConf) sign(payload, client string, hops int, via string) []byte {
+	m := hmac.New(sha256.New, []byte(cc.Secret))
+	fmt.Fprintf(m, "%s%s\n%s\n%d\n%s", chainTokenPrefix, payload, client, hops, via)
+	return m.Sum(nil)
+}
+
+// 上一跳网关传来的信息
+type chainHop struct {
+	token *tokenInfo
+	sid   string
+	hops  int
+	via   []string
+	ip    net.IP //client_ip 为 proxy_protocol 时为 nil
+	port  int
+}
+
+// 验证上一跳的内层 token, 不是级联请求时返回 nil, nil
+func chainHopFrom(r *http.Request) (*chainHop, error) {
+	raw := strings.TrimSpace(strings.Replace(r.FormValue(cfgFormKey), " ", "+", -1))
+	if !strings.HasPrefix(raw, chainTokenPrefix) {
+		return nil, nil
+	}
+	cc := cfg.Chain
+	if cc == nil {
+		return nil, errors.New("chain not configured")
+	}
+	parts := strings.Split(strings.TrimPrefix(raw, chainTokenPrefix), ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+
+	hops, err := strconv.Atoi(r.Header.Get(chainHopsHeader))
+	if err != nil || hops < 1 {
+		return nil, fmt.Errorf("bad %s", chainHopsHeader)
+	}
+	via := r.Header.Get(chainViaHeader)
+	client := r.Header.Get(chainAddrHeader)
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, cc.sign(parts[0], client, hops, via)) {
+		return nil, errChainSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	var c chainClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, errors.New("malformed token")
+	}
+	if time.Now().Unix() > c.Exp {
+		return nil, errors.New("token expired")
+	}
+	//会话ID会写入日志与头部, 只接受 UUID
+	if _, err := uuid.Parse(c.SID); err != nil {
+		return nil, errors.New("bad session id")
+	}
+	if !chainOnce(parts[1], c.Exp) {
+		return nil, errors.New("token replayed")
+	}
+
+	h := &chainHop{sid: c.SID, hops: hops}
+	for _, id := range strings.Split(via, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			h.via = append(h.via, id)
+		}
+		if id == cc.ID {
+			return nil, fmt.Errorf("%w: via %s", errChainLoop, via)
+		}
+	}
+	if hops > cc.MaxHops {
+		return nil, fmt.Errorf("%w: %d hops exceed max_hops", errChainLoop, hops)
+	}
+
+	h.token = &tokenInfo{Addr: strings.TrimSpace(c.Addr), URL: c.URL, Claims: c.Claims}
+	if c.URL != "" {
+		addr, ok := urlAddr(c.URL)
+		if !ok {
+			return nil, errors.New("bad url in token")
+		}
+		h.token.Addr = addr
+	}
+	if h.token.Addr == "" {
+		return nil, errors.New("no target in token")
+	}
+
+	if client != "" {
+		if h.ip, h.port = parseHop(client); h.ip == nil {
+			return nil, fmt.Errorf("bad %s", chainAddrHeader)
+		}
+	}
+	return h, nil
+}
+
+// 客户端地址以签名中的为准, 否则 (proxy_protocol) 按原来的方式解析
+func (h *chainHop) withClient(r *http.Request) *http.Request {
+	if h.ip == nil {
+		return withClientAddr(r)
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, clientIP{h.ip, h.port}))
+}
+
+// 连接下一跳时的内层 token 与头部, in 为上一跳传来的信息 (本网关是第一跳时为 nil)
+func (cc *ChainConf) outbound(tk *tokenInfo, sid string, ip net.IP, port int, in *chainHop) (string, http.Header) {
+	hops, via := 1, []string{cc.ID}
+	if in != nil {
+		hops = in.hops + 1
+		via = append(append([]string(nil), in.via...), cc.ID)
+	}
+	viaStr := strings.Join(via, ", ")
+
+	var client string
+	if cc.ClientIP == chainClientHeader && ip != nil {
+		client = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	data, _ := json.Marshal(&chainClaims{
+		Addr:   tk.Addr,
+		URL:    tk.URL,
+		Claims: tk.Claims,
+		SID:    sid,
+		Exp:    time.Now().Add(time.Duration(cc.TTL) * time.Second).Unix(),
+		Nonce:  chainNonce(),
+	})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	token := chainTokenPrefix + payload + "." +
+		base64.RawURLEncoding.EncodeToString(cc.sign(payload, client, hops, viaStr))
+
+	h := http.Header{}
+	h.Set(chainHopsHeader, strconv.Itoa(hops))
+	h.Set(chainViaHeader, viaStr)
+	if client != "" {
+		h.Set(chainAddrHeader, client)
+	}
+	h.Set(sessionHeader, sid)
+	return token, h
+}
+
+// 每个内层 token 不同, 重试时重新生成的 token 不会被当作重放
+func chainNonce() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// 在 ws 地址中附加 token 参数
+func withTokenParam(raw, token string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(cfgFormKey, token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// 连接下一跳网关的握手地址与头部
+func (rt *RouteConf) nextHopRequest(r *http.Request, sid string, tk *tokenInfo, in *chainHop) (string, http.Header, error) {
+	ip, port := clientAddr(r)
+	token, ch := cfg.Chain.outbound(tk, sid, ip, port, in)
+	u, err := withTokenParam(rt.NextHop, token)
+	if err != nil {
+		return "", nil, err
+	}
+	h := backendHeader(r, sid, tk)
+	for k, vs := range ch {
+		h[k] = vs
+	}
+	return u, h, nil
+}
+
+// client_ip 为 proxy_protocol 时, 连接建立后先发送 PROXY v2 头
+// 经由上游代理时 (proxy 非 nil) 头部会发给代理, 此时不发送
+func chainDialer(d *websocket.Dialer, proxy *url.URL, ip net.IP, port int, sid string) {
+	if cfg.Chain.ClientIP != chainClientPP || proxy != nil {
+		return
+	}
+	dial := d.NetDialContext
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeChainPP(c, ip, port, sid); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("proxy protocol: %w", err)
+		}
+		return c, nil
+	}
+}
+
+func writeChainPP(c net.Conn, ip net.IP, port int, sid string) error {
+	h := &proxyproto.Header{Version: 2, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	dst, ok := c.RemoteAddr().(*net.TCPAddr)
+	if ip != nil && ok {
+		src := ip
+		dstIP := dst.IP
+		v4 := src.To4() != nil && dstIP.To4() != nil
+		if v4 {
+			src, dstIP = src.To4(), dstIP.To4()
+		} else {
+			src, dstIP = src.To16(), dstIP.To16()
+		}
+		h.Command = proxyproto.PROXY
+		h.TransportProtocol = If(v4, proxyproto.TCPv4, proxyproto.TCPv6).(proxyproto.AddressFamilyAndProtocol)
+		h.SourceAddr = &net.TCPAddr{IP: src, Port: port}
+		h.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: dst.Port}
+	}
+	if err := h.SetTLVs([]proxyproto.TLV{{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte(sid)}}); err != nil {
+		return err
+	}
+	_, err := h.WriteTo(c)
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func chainTestConf(t *testing.T, id string) *ChainConf {
+	cc := &ChainConf{Secret: "shared", ID: id}
+	if err := cc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+// 以 cc 的身份生成连接下一跳的握手请求
+func chainRequest(cc *ChainConf, sid string, in *chainHop) *http.Request {
+	token, h := cc.outbound(&tokenInfo{Addr: "10.0.0.1:9000"}, sid, net.IPv4(127, 0, 0, 5), 4000, in)
+	r := httptest.NewRequest("GET", "/?"+url.Values{cfgFormKey: {token}}.Encode(), nil)
+	for k, vs := range h {
+		r.Header[k] = vs
+	}
+	return r
+}
+
+func TestChainHop(t *testing.T) {
+	saved := cfg.Chain
+	defer func() { cfg.Chain = saved }()
+	edge := chainTestConf(t, "edge")
+	cfg.Chain = chainTestConf(t, "inner")
+
+	sid := newSessionID()
+	h, err := chainHopFrom(chainRequest(edge, sid, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.sid != sid || h.hops != 1 || h.token.Addr != "10.0.0.1:9000" || !h.ip.Equal(net.IPv4(127, 0, 0, 5)) {
+		t.Fatalf("hop = %+v", h)
+	}
+
+	//经过 inner 之后又回到 inner
+	cfg.Chain = chainTestConf(t, "edge")
+	r := chainRequest(chainTestConf(t, "inner"), newSessionID(), &chainHop{hops: 1, via: []string{"edge"}})
+	if _, err := chainHopFrom(r); !errors.Is(err, errChainLoop) {
+		t.Fatalf("err = %v, want loop", err)
+	}
+}
+
+func TestChainHopReplay(t *testing.T) {
+	saved := cfg.Chain
+	defer func() { cfg.Chain = saved }()
+	edge := chainTestConf(t, "edge")
+	cfg.Chain = chainTestConf(t, "inner")
+
+	sid := newSessionID()
+	r := chainRequest(edge, sid, nil)
+	if _, err := chainHopFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chainHopFrom(r); err == nil {
+		t.Fatal("replayed token accepted")
+	}
+
+	//同一个会话重新生成的 token (重试) 可以使用
+	if _, err := chainHopFrom(chainRequest(edge, sid, nil)); err != nil {
+		t.Fatalf("fresh token for the same session rejected: %v", err)
+	}
+}
+
+func TestChainHopSignature(t *testing.T) {
+	saved := cfg.Chain
+	defer func() { cfg.Chain = saved }()
+	cfg.Chain = chainTestConf(t, "inner")
+
+	r := chainRequest(chainTestConf(t, "edge"), newSessionID(), nil)
+	r.Header.Set(chainAddrHeader, "127.0.0.6:4000")
+	if _, err := chainHopFrom(r); err != errChainSignature {
+		t.Fatalf("err = %v, want bad signature", err)
+	}
+}
+
+func TestChainOnceSweep(t *testing.T) {
+	now := time.Now().Unix()
+	if !chainOnce("old", now-10) || !chainOnce("live", now+30) {
+		t.Fatal("fresh token rejected")
+	}
+	if chainOnce("live", now+30) {
+		t.Fatal("replayed token accepted")
+	}
+	//下一秒清理时整桶删除已过期的
+	chainSeen.Lock()
+	chainSeen.swept = 0
+	chainSeen.Unlock()
+	chainOnce("other", now+30)
+	chainSeen.Lock()
+	_, old := chainSeen.buckets[now-10]
+	_, live := chainSeen.buckets[now+30]
+	chainSeen.Unlock()
+	if old || !live {
+		t.Fatalf("after sweep: expired bucket kept %v, live bucket kept %v", old, live)
+	}
+}
+
+// 大量未过期 token 时每次握手的开销
+func BenchmarkChainOnce(b *testing.B) {
+	exp := time.Now().Unix() + 30
+	for i := 0; i < 100000; i++ {
+		chainOnce(newSessionID(), exp)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			chainOnce(newSessionID(), exp)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ************************************************************
+// 客户端真实地址
+//
+// 只有直连的对端 (r.RemoteAddr, 已经过 PROXY 协议头解析) 在 trusted_proxies
+// 之中或者来自 unix socket 监听地址时才读取转发头部, 并且只读取 real_ip_header
+// 指定的一个头部 (默认 X-Forwarded-For)。代理通常只追加自己的头部, 客户端
+// 发来的其他转发头部会被原样转发, 不能按优先级从几个头部中选择。
+// Forwarded 按 RFC 7239 解析 for=, 其他头部按逗号分隔的地址列表解析。
+//
+// 转发链从右往左解析, 跳过可信代理, 遇到第一个不可信地址即为客户端,
+// 客户端自己伪造的左侧地址不会被采用。
+// 日志、发往后端的 PROXY 头、限制等都使用同一个解析结果。
+// ************************************************************
+
+var trustedProxies []*net.IPNet
+
+// 可信代理写入客户端地址的头部
+var realIPHeader = "X-Forwarded-For"
+
+type clientKey struct{}
+
+type clientIP struct {
+	ip   net.IP
+	port int //转发头中没有端口时为0
+}
+
+// 解析一次并保存在请求的 context 中
+func withClientAddr(r *http.Request) *http.Request {
+	ip, port := resolveClient(r)
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, clientIP{ip, port}))
+}
+
+// 客户端真实地址
+func clientAddr(r *http.Request) (net.IP, int) {
+	if c, ok := r.Context().Value(clientKey{}).(clientIP); ok {
+		return c.ip, c.port
+	}
+	return resolveClient(r)
+}
+
+// 客户端真实IP的文本形式
+func clientIPString(r *http.Request) string {
+	ip, _ := clientAddr(r)
+	if ip == nil {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	}
+	return ip.String()
+}
+
+func resolveClient(r *http.Request) (net.IP, int) {
+	host, port, _ := net.SplitHostPort(r.RemoteAddr)
+	peer := net.ParseIP(host)
+	peerPort, _ := strconv.Atoi(port)
+
+	if !trustedPeer(r, peer) {
+		return peer, peerPort
+	}
+
+	var chain []string
+	if h := http.CanonicalHeaderKey(realIPHeader); h == "Forwarded" {
+		chain = forwardedFor(r.Header.Values(h))
+	} else {
+		for _, v := range r.Header.Values(h) {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	}
+
+	ip, p := peer, peerPort
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, hopPort := parseHop(chain[i])
+		if hop == nil {
+			// unknown 或混淆标识, 无法继续向左追溯
+			break
+		}
+		ip, p = hop, hopPort
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip, p
+}
+
+// 直连的对端是否可信: 在 trusted_proxies 中, 或者来自 unix socket (本机)
+func trustedPeer(r *http.Request, peer net.IP) bool {
+	if peer == nil {
+		return unixPeer(r)
+	}
+	return containsIP(trustedProxies, peer)
+}
+
+// Forwarded: for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"
+// 返回所有 for= 的值, 顺序与头部一致
+func forwardedFor(values []string) []string {
+	var fors []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			found := ""
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					found = strings.Trim(kv[1], "\"")
+				}
+			}
+			fors = append(fors, found)
+		}
+	}
+	return fors
+}
+
+// 解析转发链中的一跳: 1.2.3.4 / 1.2.3.4:80 / [::1] / [::1]:80 / ::1
+func parseHop(s string) (net.IP, int) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return ip, 0
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.Atoi(port)
+	return net.ParseIP(host), p
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClient(t *testing.T) {
+	savedNets, savedHeader := trustedProxies, realIPHeader
+	defer func() { trustedProxies, realIPHeader = savedNets, savedHeader }()
+	trustedProxies, _ = parseCIDRs([]string{"10.0.0.0/8"})
+
+	for _, c := range []struct {
+		name    string
+		header  string //real_ip_header, 空为默认
+		remote  string
+		unix    bool
+		headers map[string]string
+		want    string
+	}{
+		{name: "untrusted peer", remote: "198.51.100.7:4000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4"}, want: "198.51.100.7"},
+		{name: "trusted peer", remote: "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "no header", remote: "10.0.0.1:4000", want: "10.0.0.1"},
+		{name: "spoofed xff left of proxy entry", remote: "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "trusted hops skipped", remote: "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.9, 10.0.0.2"}, want: "203.0.113.9"},
+		{name: "spoofed forwarded ignored", remote: "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "spoofed x-real-ip ignored", remote: "10.0.0.1:4000",
+			headers: map[string]string{"X-Real-IP": "1.2.3.4", "X-Forwarded-For": "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "spoofed forwarded only", remote: "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": "for=1.2.3.4"}, want: "10.0.0.1"},
+		{name: "spoofed forwarded from unix socket", remote: "@", unix: true,
+			headers: map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "x-real-ip header", header: "X-Real-IP", remote: "10.0.0.1:4000",
+			headers: map[string]string{"X-Real-IP": "203.0.113.9", "X-Forwarded-For": "1.2.3.4"}, want: "203.0.113.9"},
+		{name: "forwarded header", header: "forwarded", remote: "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::17]:4711"`, "X-Forwarded-For": "1.2.3.4"}, want: "2001:db8::17"},
+		{name: "forwarded header unknown", header: "Forwarded", remote: "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": "for=unknown"}, want: "10.0.0.1"},
+	} {
+		realIPHeader = savedHeader
+		if c.header != "" {
+			realIPHeader = c.header
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		if c.unix {
+			r = r.WithContext(context.WithValue(r.Context(), listenerKey{}, &ListenerConf{network: "unix"}))
+		}
+		if got := clientIPString(r); got != c.want {
+			t.Errorf("%s: client = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorilla/websocket"
+	"net"
+	"syscall"
+)
+
+// 网关主动断开客户端时的原因, 对应配置文件中 close_codes 的键名
+const (
+	closeDialTimeout  = "dial_timeout"  //后端连接超时
+	closeDialRefused  = "dial_refused"  //后端拒绝连接
+	closeDialError    = "dial_error"    //后端其他连接错误
+	closeCircuitOpen  = "circuit_open"  //后端熔断中, 未尝试连接
+	closeBackendReset = "backend_reset" //后端连接被重置
+	closePolicy       = "policy"        //策略拒绝
+	closeOverload     = "overload"      //超过最大连接数
+	closeBadToken     = "bad_token"     //token无法解析
+	closeChainLoop    = "chain_loop"    //级联网关出现环路或超过跳数
+)
+
+// 发送给客户端的 close code 和可读原因
+// 1xxx 为 RFC 6455 定义的标准码, 4xxx 为应用自定义码,
+// 客户端 SDK 可以据此决定是否重试
+type CloseCode struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+var closeCodes = map[string]CloseCode{
+	closeDialTimeout:  {websocket.CloseTryAgainLater, "backend dial timeout"},
+	closeDialRefused:  {4502, "backend connection refused"},
+	closeDialError:    {websocket.CloseInternalServerErr, "backend unavailable"},
+	closeCircuitOpen:  {4504, "backend circuit open"},
+	closeBackendReset: {4503, "backend connection reset"},
+	closePolicy:       {websocket.ClosePolicyViolation, "policy violation"},
+	closeOverload:     {websocket.CloseTryAgainLater, "too many connections"},
+	closeBadToken:     {4401, "invalid token"},
+	closeChainLoop:    {4508, "gateway loop detected"},
+}
+
+// 用配置覆盖默认映射, 未配置的原因保持默认值
+func setCloseCodes(m map[string]CloseCode) error {
+	for k, c := range m {
+		if _, ok := closeCodes[k]; !ok {
+			return fmt.Errorf("close_codes: unknown reason '%s'", k)
+		}
+		if !validCloseCode(c.Code) {
+			return fmt.Errorf("close_codes: '%s' code %d can't be sent in a close frame", k, c.Code)
+		}
+		// close帧的负载不能超过125字节, 其中2字节为 code
+		if len(c.Reason) > 123 {
+			return fmt.Errorf("close_codes: '%s' reason too long", k)
+		}
+		closeCodes[k] = c
+	}
+	return nil
+}
+
+// 1004/1005/1006/1015 只能用于本地表示, 不能出现在close帧中
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// 拨号错误归类
+func dialErrorReason(err error) string {
+	if errors.Is(err, errCircuitOpen) {
+		return closeCircuitOpen
+	}
+	if isTimeout(err) {
+		return closeDialTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return closeDialRefused
+	}
+	return closeDialError
+}
+
+// 经上游代理拨号时错误被包装过, 需要逐层查找
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// 发送带原因的close帧后关闭连接, 浏览器端不再只看到 1006
+func closeWith(ws *websocket.Conn, reason string) {
+	c := closeCodes[reason]
+	closeFrame(ws, c.Code, c.Reason)
+	ws.Close()
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"gorilla/websocket"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ************************************************************
+// permessage-deflate 压缩 (RFC 7692), 按路由配置
+//
+//	"compression": {
+//	  "tcp": {"enable": true, "level": 1, "min_size": 256},
+//	  "ws":  {"enable": true, "level": 1, "min_size": 256,
+//	          "backend": {"enable": false}}  //与后端单独协商, 未配置时同客户端
+//	}
+//
+// level 为 flate 压缩级别 (-2 ~ 9, 默认 1), 小于 min_size 的消息不压缩。
+// /ws 路由两端各自协商, 消息在网关解压后按另一端的协商结果重新压缩。
+// ************************************************************
+type CompressConf struct {
+	Enable  bool          `json:"enable"`
+	Level   int           `json:"level"`
+	MinSize int           `json:"min_size"`
+	Backend *CompressConf `json:"backend"`
+}
+
+func (cc *CompressConf) compile() error {
+	if cc.Level == 0 {
+		cc.Level = flate.BestSpeed
+	}
+	if cc.Level < flate.HuffmanOnly || cc.Level > flate.BestCompression {
+		return fmt.Errorf("invalid level %d", cc.Level)
+	}
+	if cc.MinSize < 0 {
+		return fmt.Errorf("invalid min_size %d", cc.MinSize)
+	}
+	if cc.Backend != nil {
+		if cc.Backend.Backend != nil {
+			return fmt.Errorf("backend: nested backend is not allowed")
+		}
+		return cc.Backend.compile()
+	}
+	return nil
+}
+
+func compileCompression(m map[string]*CompressConf) (map[string]*CompressConf, error) {
+	routes := make(map[string]*CompressConf)
+	for name, cc := range m {
+		pt, ok := routeNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown route '%s'", name)
+		}
+		if cc == nil {
+			continue
+		}
+		if err := cc.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		routes[pt] = cc
+	}
+	return routes, nil
+}
+
+// 路由客户端一侧的压缩配置, 未启用时返回 nil
+func clientCompression(cc *CompressConf) *CompressConf {
+	if cc != nil && cc.Enable {
+		return cc
+	}
+	return nil
+}
+
+// /ws 路由后端一侧的压缩配置, 未启用时返回 nil
+func backendCompression(cc *CompressConf) *CompressConf {
+	if cc != nil && cc.Backend != nil {
+		cc = cc.Backend
+	}
+	if cc != nil && cc.Enable {
+		return cc
+	}
+	return nil
+}
+
+// 握手头部中是否有 permessage-deflate 扩展
+func deflateNegotiated(h http.Header) bool {
+	for _, v := range h.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name := strings.SplitN(ext, ";", 2)[0]
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 一端 websocket 连接的压缩设置与统计
+type compressLeg struct {
+	conf    *CompressConf
+	meter   *meteredConn
+	base    int64 //握手完成时底层连接已收发的字节数
+	payload int64
+}
+
+// 握手完成后调用, h 为对端的握手头部, 未启用或未协商压缩时返回 nil
+func newCompressLeg(c *websocket.Conn, cc *CompressConf, h http.Header) *compressLeg {
+	if cc == nil || !deflateNegotiated(h) {
+		return nil
+	}
+	c.SetCompressionLevel(cc.Level)
+	l := &compressLeg{conf: cc, meter: meterOf(c.UnderlyingConn())}
+	if l.meter != nil {
+		l.base = l.meter.total()
+	}
+	return l
+}
+
+func (l *compressLeg) received(n int) {
+	if l != nil {
+		atomic.AddInt64(&l.payload, int64(n))
+	}
+}
+
+// 发送消息, 小于 min_size 的不压缩
+func (l *compressLeg) write(c *websocket.Conn, typ int, buf []byte) error {
+	if l != nil {
+		c.EnableWriteCompression(len(buf) >= l.conf.MinSize)
+		atomic.AddInt64(&l.payload, int64(len(buf)))
+	}
+	return c.WriteMessage(typ, buf)
+}
+
+// 会话结束时计入压缩率
+func (l *compressLeg) done() {
+	if l == nil || l.meter == nil {
+		return
+	}
+	atomic.AddInt64(&metrics.compressPayload, atomic.LoadInt64(&l.payload))
+	atomic.AddInt64(&metrics.compressWire, l.meter.total()-l.base)
+}
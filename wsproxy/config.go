@@ -0,0 +1,189 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// 扩展配置 (JSON格式, 由 -conf 指定)
+// 命令行参数仍然有效, 配置文件只承载不方便用参数表达的部分
+type Config struct {
+	CloseCodes map[string]CloseCode `json:"close_codes"`
+	Backends   []*BackendConf       `json:"backends"`
+	AcceptPP   *AcceptPPConf        `json:"accept_proxy_protocol"`
+	WSHeaders  *HeaderConf          `json:"ws_headers"`
+
+	Subprotocols []string                 `json:"subprotocols"` //TCP/UDP 路由允许的子协议
+	Compression  map[string]*CompressConf `json:"compression"`  //按路由的压缩设置
+	Origins      map[string]*OriginConf   `json:"origins"`      //允许的 Origin, "*" 为所有路由的默认值
+
+	Routes []*RouteConf          `json:"routes"` //路由表, 未配置时使用 / /udp /ws
+	Groups map[string]*GroupConf `json:"groups"` //后端组
+	VHosts []*VHostConf          `json:"vhosts"` //按 SNI/Host 选择的虚拟主机
+
+	Listeners []*ListenerConf `json:"listeners"` //监听地址, 未配置时使用 -addr
+	Admin     string          `json:"admin"`     //管理端口, 只能是本机地址, 未配置时不监听
+	Tunnels   []*TunnelConf   `json:"tunnels"`   //反向隧道: 本地 TCP 端口 -> 远端 websocket
+
+	TrustedProxies []string `json:"trusted_proxies"` //可信代理, 只信任它们添加的转发头部
+	RealIPHeader   string   `json:"real_ip_header"`  //可信代理写入客户端地址的头部, 默认 X-Forwarded-For
+
+	Upstream *UpstreamConf `json:"upstream"` //连接后端时经由的上游代理, 路由可覆盖
+	Dial     *DialConf     `json:"dial"`     //连接后端时的源地址与 socket 选项, 路由可覆盖
+	Resolver *ResolverConf `json:"resolver"` //后端域名解析与缓存
+	Retry    *RetryConf    `json:"retry"`    //连接后端失败时的重试, 路由可覆盖
+	Breaker  *BreakerConf  `json:"breaker"`  //按后端地址的熔断器
+	Chain    *ChainConf    `json:"chain"`    //网关级联的签名密钥与跳数限制
+
+	// 按协议 tcp/udp/wss 编译后的路由设置
+	compress map[string]*CompressConf
+	origins  map[string]*OriginConf
+}
+
+var cfg = &Config{}
+
+// 配置中按路由设置的项使用的路由名 -> 后端协议
+var routeNames = map[string]string{
+	"tcp": "tcp",
+	"udp": "udp",
+	"ws":  "wss",
+	"mux": "mux",
+}
+
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := setCloseCodes(c.CloseCodes); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	for _, b := range c.Backends {
+		if err := b.compile(); err != nil {
+			return fmt.Errorf("%s: backends %v: %s", path, b.Match, err)
+		}
+	}
+
+	if c.AcceptPP != nil {
+		if err := c.AcceptPP.compile(); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	if c.WSHeaders != nil {
+		c.WSHeaders.compile()
+	}
+
+	if c.compress, err = compileCompression(c.Compression); err != nil {
+		return fmt.Errorf("%s: compression: %s", path, err)
+	}
+
+	if c.origins, err = compileOrigins(c.Origins); err != nil {
+		return fmt.Errorf("%s: origins: %s", path, err)
+	}
+
+	if c.Upstream != nil {
+		if err := c.Upstream.compile(); err != nil {
+			return fmt.Errorf("%s: upstream: %s", path, err)
+		}
+	}
+
+	if c.Dial != nil {
+		if err := c.Dial.compile(); err != nil {
+			return fmt.Errorf("%s: dial: %s", path, err)
+		}
+	}
+
+	if c.Retry != nil {
+		if err := c.Retry.compile(); err != nil {
+			return fmt.Errorf("%s: retry: %s", path, err)
+		}
+	}
+	if c.Breaker != nil {
+		if err := c.Breaker.compile(); err != nil {
+			return fmt.Errorf("%s: breaker: %s", path, err)
+		}
+	}
+
+	if c.Resolver != nil {
+		if err := c.Resolver.compile(); err != nil {
+			return fmt.Errorf("%s: resolver: %s", path, err)
+		}
+	}
+
+	for name, g := range c.Groups {
+		if err := g.compile(If(c.Resolver != nil, c.Resolver, defaultResolver).(*ResolverConf)); err != nil {
+			return fmt.Errorf("%s: groups %s: %s", path, name, err)
+		}
+	}
+
+	if c.Chain != nil {
+		if err := c.Chain.compile(); err != nil {
+			return fmt.Errorf("%s: chain: %s", path, err)
+		}
+	}
+
+	for _, rt := range c.Routes {
+		if err := rt.compile(c.Groups); err != nil {
+			return fmt.Errorf("%s: routes %s: %s", path, rt.Path, err)
+		}
+		if rt.NextHop != "" && c.Chain == nil {
+			return fmt.Errorf("%s: routes %s: next_hop requires chain", path, rt.Path)
+		}
+	}
+
+	for _, vh := range c.VHosts {
+		if err := vh.compile(c.Groups); err != nil {
+			return fmt.Errorf("%s: vhosts %v: %s", path, vh.Hosts, err)
+		}
+	}
+
+	for _, l := range c.Listeners {
+		if err := l.compile(); err != nil {
+			return fmt.Errorf("%s: listeners %s: %s", path, l.Addr, err)
+		}
+	}
+	if c.Admin != "" {
+		if err := checkAdminAddr(c.Admin); err != nil {
+			return fmt.Errorf("%s: admin: %s", path, err)
+		}
+	}
+
+	for _, t := range c.Tunnels {
+		if err := t.compile(); err != nil {
+			return fmt.Errorf("%s: tunnels %s: %s", path, t.Listen, err)
+		}
+		if t.Chain && c.Chain == nil {
+			return fmt.Errorf("%s: tunnels %s: chain not configured", path, t.Listen)
+		}
+	}
+
+	nets, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("%s: trusted_proxies: %s", path, err)
+	}
+	trustedProxies = nets
+	if c.RealIPHeader != "" {
+		realIPHeader = c.RealIPHeader
+	}
+
+	staticSubprotocols = append(staticSubprotocols, c.Subprotocols...)
+
+	cfg = c
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// ************************************************************
+// 最小的 DNS 客户端 (RFC 1035), 只用于配置了 resolver.servers 时
+//
+// 标准库的解析器不给出 TTL, 缓存需要按记录的 TTL 过期, 所以自己发查询。
+// 只支持 A/AAAA/SRV, UDP 应答被截断 (TC) 时改用 TCP 重查。
+// ************************************************************
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsRcodeNXDomain = 3
+	dnsUDPSize       = 4096
+)
+
+type dnsRR struct {
+	typ uint16
+	ttl uint32
+	ip  net.IP
+	srv *net.SRV
+}
+
+// 向 server 查询一次, 返回应答中的记录与 rcode
+func dnsExchange(ctx context.Context, server, name string, qtype uint16) ([]dnsRR, int, error) {
+	id := uint16(rand.Uint32())
+	q, err := dnsQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+	msg, err := dnsRoundTrip(ctx, &d, "udp", server, q)
+	if err == nil && len(msg) >= 3 && msg[2]&0x02 != 0 {
+		//TC: 应答被截断
+		msg, err = dnsRoundTrip(ctx, &d, "tcp", server, q)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return dnsParse(msg, id)
+}
+
+func dnsRoundTrip(ctx context.Context, d *net.Dialer, network, server string, q []byte) ([]byte, error) {
+	c, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+		if _, err := c.Write(append(msg, q...)); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return nil, err
+		}
+		msg = make([]byte, binary.BigEndian.Uint16(l[:]))
+		_, err := io.ReadFull(c, msg)
+		return msg, err
+	}
+
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		//丢弃ID不符的应答 (迟到的或伪造的)
+		if n >= 2 && buf[0] == q[0] && buf[1] == q[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// 查询报文: 头部 + 问题 + EDNS0 OPT (声明 UDP 可接收 4096 字节)
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], id)
+	b[2] = 0x01 //RD
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[10:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name '%s'", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, dnsUDPSize)
+	return append(b, 0, 0, 0, 0, 0, 0), nil
+}
+
+var errDNSFormat = errors.New("malformed dns message")
+
+func dnsParse(msg []byte, id uint16) ([]dnsRR, int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, 0, errDNSFormat
+	}
+	rcode := int(msg[3] & 0x0f)
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, n, err := dnsName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = n + 4
+	}
+
+	var rrs []dnsRR
+	for i := 0; i < an; i++ {
+		_, n, err := dnsName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, 0, errDNSFormat
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		l := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+l > len(msg) {
+			return nil, 0, errDNSFormat
+		}
+		data := msg[off : off+l]
+
+		//CNAME 链由递归服务器展开, 只取其中的地址记录
+		switch {
+		case typ == dnsTypeA && l == net.IPv4len:
+			rrs = append(rrs, dnsRR{typ: typ, ttl: ttl, ip: net.IP(append([]byte(nil), data...))})
+		case typ == dnsTypeAAAA && l == net.IPv6len:
+			rrs = append(rrs, dnsRR{typ: typ, ttl: ttl, ip: net.IP(append([]byte(nil), data...))})
+		case typ == dnsTypeSRV && l > 6:
+			target, _, err := dnsName(msg, off+6)
+			if err != nil {
+				return nil, 0, err
+			}
+			rrs = append(rrs, dnsRR{typ: typ, ttl: ttl, srv: &net.SRV{
+				Priority: binary.BigEndian.Uint16(data[0:]),
+				Weight:   binary.BigEndian.Uint16(data[2:]),
+				Port:     binary.BigEndian.Uint16(data[4:]),
+				Target:   target,
+			}})
+		}
+		off += l
+	}
+	return rrs, rcode, nil
+}
+
+// 读取域名 (支持压缩指针), 返回名称与名称之后的偏移
+func dnsName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSFormat
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// 依次询问各个服务器, 第一个给出应答 (包括 NXDOMAIN) 的为准
+func dnsLookup(ctx context.Context, servers []string, timeout time.Duration, name string, qtype uint16) ([]dnsRR, error) {
+	var lastErr error
+	for _, server := range servers {
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		rrs, rcode, err := dnsExchange(qctx, server, name, qtype)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch rcode {
+		case 0:
+			return rrs, nil
+		case dnsRcodeNXDomain:
+			return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+		default:
+			lastErr = &net.DNSError{Err: fmt.Sprintf("server misbehaving (rcode %d)", rcode), Name: name, Server: server}
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no dns servers")
+	}
+	if ne, ok := lastErr.(*net.DNSError); ok {
+		return nil, ne
+	}
+	return nil, &net.DNSError{Err: lastErr.Error(), Name: name, IsTimeout: isTimeout(lastErr), IsTemporary: true}
+}
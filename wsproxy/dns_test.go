@@ -0,0 +1,272 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 应答中的一条记录, 名称总是压缩指针指向问题中的名称
+type stubRR struct {
+	typ   uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// 本地 DNS 服务器, 同一端口同时监听 UDP 与 TCP
+type stubDNS struct {
+	addr    string
+	udp     net.PacketConn
+	tcp     net.Listener
+	queries int32 //收到的查询数 (UDP 与 TCP)
+
+	// 返回 rcode、记录以及 UDP 应答是否截断
+	answer func(name string, qtype uint16, tcp bool) (int, []stubRR, bool)
+}
+
+func newStubDNS(t *testing.T, answer func(name string, qtype uint16, tcp bool) (int, []stubRR, bool)) *stubDNS {
+	s := &stubDNS{answer: answer}
+	for i := 0; ; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err == nil {
+			s.udp, s.tcp, s.addr = udp, tcp, udp.LocalAddr().String()
+			break
+		}
+		udp.Close()
+		if i > 10 {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *stubDNS) serveUDP() {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.reply(buf[:n], false); resp != nil {
+			s.udp.WriteTo(resp, from)
+		}
+	}
+}
+
+func (s *stubDNS) serveTCP() {
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var l [2]byte
+			if _, err := io.ReadFull(c, l[:]); err != nil {
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(c, q); err != nil {
+				return
+			}
+			if resp := s.reply(q, true); resp != nil {
+				c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}
+		}()
+	}
+}
+
+func (s *stubDNS) reply(q []byte, tcp bool) []byte {
+	atomic.AddInt32(&s.queries, 1)
+	name, end, err := dnsName(q, 12)
+	if err != nil || end+4 > len(q) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(q[end:])
+	rcode, rrs, tc := s.answer(name, qtype, tcp)
+
+	b := append([]byte(nil), q[:2]...)
+	flags := uint16(0x8180) | uint16(rcode)
+	if tc && !tcp {
+		flags |= 0x0200
+		rrs = nil
+	}
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rrs)))
+	b = append(b, 0, 0, 0, 0)
+	b = append(b, q[12:end+4]...)
+	for _, rr := range rrs {
+		b = append(b, 0xc0, 12)
+		b = binary.BigEndian.AppendUint16(b, rr.typ)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+		b = binary.BigEndian.AppendUint32(b, rr.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rr.rdata)))
+		b = append(b, rr.rdata...)
+	}
+	return b
+}
+
+func stubResolver(t *testing.T, s *stubDNS, rc *ResolverConf) *ResolverConf {
+	rc.Servers = []string{s.addr}
+	if err := rc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func TestDNSLookupA(t *testing.T) {
+	s := newStubDNS(t, func(name string, qtype uint16, tcp bool) (int, []stubRR, bool) {
+		if name != "db.example.com." || qtype != dnsTypeA {
+			return dnsRcodeNXDomain, nil, false
+		}
+		return 0, []stubRR{{dnsTypeA, 60, []byte{10, 0, 0, 7}}}, false
+	})
+	rrs, err := dnsLookup(context.Background(), []string{s.addr}, time.Second, "db.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || !rrs[0].ip.Equal(net.IPv4(10, 0, 0, 7)) || rrs[0].ttl != 60 {
+		t.Fatalf("rrs = %+v", rrs)
+	}
+}
+
+func TestDNSTTLClamp(t *testing.T) {
+	for _, c := range []struct {
+		ttl  uint32
+		want time.Duration
+	}{
+		{1, 5 * time.Second},
+		{60, 60 * time.Second},
+		{86400, 300 * time.Second},
+	} {
+		ttl := c.ttl
+		s := newStubDNS(t, func(name string, qtype uint16, tcp bool) (int, []stubRR, bool) {
+			return 0, []stubRR{{dnsTypeA, ttl, []byte{10, 0, 0, 1}}}, false
+		})
+		rc := stubResolver(t, s, &ResolverConf{MinTTL: 5, MaxTTL: 300, Prefer: "ipv4_only"})
+		_, got, err := rc.resolve("db.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("ttl %d: cached for %v, want %v", c.ttl, got, c.want)
+		}
+	}
+}
+
+func TestDNSNegativeCache(t *testing.T) {
+	s := newStubDNS(t, func(name string, qtype uint16, tcp bool) (int, []stubRR, bool) {
+		return dnsRcodeNXDomain, nil, false
+	})
+	rc := stubResolver(t, s, &ResolverConf{Prefer: "ipv4_only", NegativeTTL: 60})
+	for i := 0; i < 3; i++ {
+		_, err := rc.lookupIP(context.Background(), "missing.example.com")
+		if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+			t.Fatalf("lookup %d: err = %v, want not found", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&s.queries); n != 1 {
+		t.Fatalf("%d queries sent, want 1 (negative answer cached)", n)
+	}
+
+	//过期后重新查询
+	rc.mu.Lock()
+	rc.cache["missing.example.com"].expire = time.Now().Add(-time.Second)
+	rc.mu.Unlock()
+	rc.lookupIP(context.Background(), "missing.example.com")
+	if n := atomic.LoadInt32(&s.queries); n != 2 {
+		t.Fatalf("%d queries sent after expiry, want 2", n)
+	}
+}
+
+func TestDNSTruncatedFallsBackToTCP(t *testing.T) {
+	s := newStubDNS(t, func(name string, qtype uint16, tcp bool) (int, []stubRR, bool) {
+		var rrs []stubRR
+		for i := 1; i <= 3; i++ {
+			rrs = append(rrs, stubRR{dnsTypeA, 30, []byte{10, 0, 1, byte(i)}})
+		}
+		return 0, rrs, true
+	})
+	rrs, err := dnsLookup(context.Background(), []string{s.addr}, time.Second, "big.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 3 {
+		t.Fatalf("%d records, want 3 from the TCP answer", len(rrs))
+	}
+	if n := atomic.LoadInt32(&s.queries); n != 2 {
+		t.Fatalf("%d queries sent, want 2 (UDP then TCP)", n)
+	}
+}
+
+func TestDNSSRVCompression(t *testing.T) {
+	// target 为 "node1." + 指向问题名称的压缩指针
+	srv := func(prio, port uint16, label string) stubRR {
+		b := binary.BigEndian.AppendUint16(nil, prio)
+		b = binary.BigEndian.AppendUint16(b, 10)
+		b = binary.BigEndian.AppendUint16(b, port)
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+		return stubRR{dnsTypeSRV, 120, append(b, 0xc0, 12)}
+	}
+	s := newStubDNS(t, func(name string, qtype uint16, tcp bool) (int, []stubRR, bool) {
+		if qtype != dnsTypeSRV {
+			return dnsRcodeNXDomain, nil, false
+		}
+		return 0, []stubRR{srv(10, 9001, "node1"), srv(10, 9002, "node2"), srv(20, 9003, "backup")}, false
+	})
+	rc := stubResolver(t, s, &ResolverConf{MaxTTL: 60})
+	addrs, ttl, err := rc.lookupSRV("_chat._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "node1._chat._tcp.example.com:9001,node2._chat._tcp.example.com:9002"
+	if got := strings.Join(addrs, ","); got != want {
+		t.Fatalf("addrs = %s, want %s", got, want)
+	}
+	if ttl != 60*time.Second {
+		t.Fatalf("ttl = %v, want 60s (max_ttl)", ttl)
+	}
+}
+
+func TestDNSNameLoop(t *testing.T) {
+	// 指向自己的压缩指针
+	msg := append(make([]byte, 12), 0xc0, 12)
+	if _, _, err := dnsName(msg, 12); err != errDNSFormat {
+		t.Fatalf("err = %v, want errDNSFormat", err)
+	}
+}
+
+func TestGroupPickBeforeSRV(t *testing.T) {
+	g := &GroupConf{SRV: "_chat._tcp.example.com"}
+	if a := g.pick(); a != "" {
+		t.Fatalf("pick() = %q before the first SRV answer, want empty", a)
+	}
+	g.srv.Store(&[]string{"10.0.0.1:9000"})
+	if a := g.pick(); a != "10.0.0.1:9000" {
+		t.Fatalf("pick() = %q", a)
+	}
+}
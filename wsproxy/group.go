@@ -0,0 +1,109 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ************************************************************
+// 后端组, 由路由引用
+//
+//	"groups": {
+//	  "game-eu": {"addrs": ["10.0.1.1:9000", "10.0.1.2:9000"]},
+//	  "game-us": {"addrs": ["10.0.2.1:9000"]},
+//	  "chat":    {"srv": "_chat._tcp.svc.example.com"}
+//	}
+//
+// 路由的 token 为 none 时由网关从组内轮询选择后端,
+// 否则组是 token 中目标地址的白名单。
+// srv: 由 SRV 记录填充 (与 addrs 合并), 只使用优先级最高的记录, 按 TTL 刷新 (见 resolver.go)
+// ************************************************************
+type GroupConf struct {
+	Addrs []string `json:"addrs"`
+	SRV   string   `json:"srv"`
+
+	next uint32
+	srv  atomic.Pointer[[]string]
+}
+
+// SRV 查询失败后的重试间隔
+const srvRetry = 5 * time.Second
+
+func (g *GroupConf) compile(rc *ResolverConf) error {
+	if len(g.Addrs) == 0 && g.SRV == "" {
+		return fmt.Errorf("no addrs")
+	}
+	for i, a := range g.Addrs {
+		a = strings.TrimSpace(a)
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("invalid addr '%s'", a)
+		}
+		g.Addrs[i] = a
+	}
+	if g.SRV != "" {
+		go g.watchSRV(rc)
+	}
+	return nil
+}
+
+// 定期重新查询 SRV 记录
+func (g *GroupConf) watchSRV(rc *ResolverConf) {
+	for {
+		addrs, ttl, err := rc.lookupSRV(g.SRV)
+		if err != nil {
+			logger.Warningf("group srv %s: %s", g.SRV, err)
+			time.Sleep(srvRetry)
+			continue
+		}
+		if old := g.srv.Load(); old == nil || strings.Join(*old, ",") != strings.Join(addrs, ",") {
+			logger.Infof("group srv %s: %s", g.SRV, strings.Join(addrs, ", "))
+		}
+		g.srv.Store(&addrs)
+		if ttl < time.Second {
+			ttl = time.Second
+		}
+		time.Sleep(ttl)
+	}
+}
+
+// 静态地址与 SRV 记录中的地址
+func (g *GroupConf) addrs() []string {
+	srv := g.srv.Load()
+	if srv == nil {
+		return g.Addrs
+	}
+	if len(g.Addrs) == 0 {
+		return *srv
+	}
+	return append(append([]string(nil), g.Addrs...), *srv...)
+}
+
+// 轮询选择一个后端, SRV 尚未解析出地址时返回空, 调用方以 dial_error 拒绝
+func (g *GroupConf) pick() string {
+	addrs := g.addrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	n := atomic.AddUint32(&g.next, 1)
+	//按 uint32 取模, 32 位平台上计数超过 2^31 后转成 int 会是负数
+	return addrs[(n-1)%uint32(len(addrs))]
+}
+
+func (g *GroupConf) has(addr string) bool {
+	for _, a := range g.addrs() {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGroupPickCounterWrap(t *testing.T) {
+	g := &GroupConf{Addrs: []string{"10.0.0.1:9000", "10.0.0.2:9000"}}
+	g.next = math.MaxInt32 - 1
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[g.pick()]++
+	}
+	if seen["10.0.0.1:9000"] != 2 || seen["10.0.0.2:9000"] != 2 {
+		t.Fatalf("picks past 2^31 = %v, want 2 each", seen)
+	}
+
+	g.next = math.MaxUint32
+	if a := g.pick(); a == "" {
+		t.Fatal("pick() empty after the counter wrapped")
+	}
+}
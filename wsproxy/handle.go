@@ -9,29 +9,31 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/aes256cbc"
-	"fmt"
+	"errors"
 	"gorilla/websocket"
 	"io"
 	"net"
 	"net/http"
-	"proxyproto"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
-	pool     = make(map[string]p_worker)
+	sessions = newRegistry()
 	upgrader = websocket.Upgrader{}
 
 	max_connections int = 65535
-	lock                = sync.Mutex{}
 
 	codeOK          = 200 //正常握手
 	codeDialErr     = 502 //后端服务不可用或没响应
 	codeCloseErr    = 503 //后端服务异常断开
 	codeDialTimeout = 504 //后端服务连接超时
+	codeCircuitOpen = 503 //后端熔断中, 未连接
 
 	copyBufPool sync.Pool
 )
@@ -42,42 +44,32 @@ type p_worker struct {
 	ws     *websocket.Conn
 	wc     *websocket.Conn
 	sock   net.Conn
+
+	proto  string    //后端协议 tcp/udp/wss
+	raddr  string    //后端地址
+	remote string    //客户端地址
+	since  time.Time //会话开始时间
+	lb     lbInfo    //负载均衡 PROXY 头中的云厂商信息
+	vhost  *VHostConf
+
+	zs *compressLeg //客户端一侧压缩, 未协商时为 nil
+	zc *compressLeg //websocket 后端一侧压缩, 未协商时为 nil
+
+	mux *muxSession //多路复用路由的流, 其他路由为 nil
+
+	wait      sync.WaitGroup
+	peerClose int32 //客户端发来的 close code
 }
 
 func setMaxConns(n int) { max_connections = n }
 
 func init() {
-	//run websocket handle
-	http.HandleFunc("/", TCP)
-	http.HandleFunc("/udp", UDP)
-	http.HandleFunc("/ws", WSS)
-
 	copyBufPool.New = func() interface{} {
 		buf := make([]byte, cfgBufferSize)
 		return &buf
 	}
 }
 
-// handle functions
-func TCP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/" {
-		handles(w, r, "tcp")
-	}
-	http.StatusText(400)
-}
-func UDP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/udp" {
-		handles(w, r, "udp")
-	}
-	http.StatusText(400)
-}
-func WSS(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/ws" {
-		handles(w, r, "wss")
-	}
-	http.StatusText(400)
-}
-
 // ************************************************************
 // Initial Upgrader
 //
@@ -92,118 +84,242 @@ func WSS(w http.ResponseWriter, r *http.Request) {
 //	}
 //
 // ************************************************************
-func handleShake(w http.ResponseWriter, r *http.Request) (ws *websocket.Conn, raddr string) {
+func handleShake(w http.ResponseWriter, r *http.Request, sid string, relay http.Header, protocols []string, compress bool) *websocket.Conn {
 
 	var upgrader = websocket.Upgrader{
-		HandshakeTimeout: time.Duration(cfgDialTimeout),
-		ReadBufferSize:   int(cfgBufferSize),
-		WriteBufferSize:  int(cfgBufferSize),
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		HandshakeTimeout:  time.Duration(cfgDialTimeout),
+		ReadBufferSize:    int(cfgBufferSize),
+		WriteBufferSize:   int(cfgBufferSize),
+		Subprotocols:      protocols,
+		EnableCompression: compress,
+		CheckOrigin:       checkOrigin,
 	}
 
 	//make header
 	//w.Header().Set("Access-Control-Allow-Origin", "*")
 	//w.Header().Set("Access-Control-Allow-Headers", "X-Requested-With")
 	//w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-	x_real_ip := strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0]
-	x_remote_addr, _, _ := net.SplitHostPort(r.RemoteAddr)
-	x_real_ip = If(x_real_ip == "", x_remote_addr, x_real_ip).(string)
+	x_real_ip := clientIPString(r)
 	w.Header().Set("X-Forwarded-For", x_real_ip)
 	w.Header().Set("X-Real-IP", x_real_ip)
+	w.Header().Set(sessionHeader, sid)
+
+	//websocket后端握手响应中需要回传给客户端的头部
+	for k, vs := range relay {
+		w.Header()[k] = vs
+	}
 
 	ws, err := upgrader.Upgrade(w, r, w.Header())
 	if _, ok := err.(websocket.HandshakeError); ok {
-		return
+		return nil
 	} else if err != nil {
-		logger.Warningf("webSocket upgrade err, %s", err)
-		return
+		logger.Warningf("webSocket upgrade err, %s, Session-Id:%s", err, sid)
+		return nil
 	}
+	return ws
+}
 
-	if len(pool) >= max_connections {
-		ws.WriteJSON(map[string]string{
-			"error": "too many connections",
-		})
-		return
+// 握手后立即以指定原因关闭, 客户端可以收到 close code
+func rejectShake(w http.ResponseWriter, r *http.Request, sid string, reason string) {
+	if ws := handleShake(w, r, sid, nil, nil, false); ws != nil {
+		if reason == closeOverload {
+			ws.WriteJSON(map[string]string{
+				"error": "too many connections",
+			})
+		}
+		closeWith(ws, reason)
 	}
+}
 
-	//收到加密串进行解码
-	var fromValueTrim string
-	fromValueTrim = strings.Replace(r.FormValue(cfgFormKey), " ", "+", -1)
-	encrypted := strings.TrimSpace(fromValueTrim)
+func handles(w http.ResponseWriter, r *http.Request, m *routeMatch) {
+	var rt, g, vh = m.route, m.group, m.vhost
+	var pt = rt.pt
+	var _t = time.Now()
+	var _h = newSessionID()
+	r = withOriginPolicy(r, rt.originPolicy())
 
-	//Token切割取样,某些时候可能会带?号,加上-fsplit可以用于切割
-	if cfgFormSplit != "" {
-		if strings.Contains(encrypted, cfgLfSplit) {
-			encrypted = strings.Split(encrypted, cfgLfSplit)[cfgRfSplit]
-		}
+	//上一跳网关转发来的请求, 沿用它的会话ID与客户端地址
+	hop, err := chainHopFrom(r)
+	if err != nil {
+		r = withClientAddr(r)
+		logger.Warningf("Chain rejected: %s, %s %s, Session-Id:%s", err, clientIPString(r), r.URL.Path, _h)
+		rejectShake(w, r, _h, If(errors.Is(err, errChainLoop), closeChainLoop, closeBadToken).(string))
+		return
+	}
+	if hop != nil {
+		_h = hop.sid
+		r = hop.withClient(r)
+	} else {
+		r = withClientAddr(r)
 	}
 
-	//同时兼容加密与非加密token,也可强制使用加密
-	_raddr := tokenModel(aesOnly, encrypted)
-	if _raddr == "__CANTNOT_DECRYPT__" {
+	//跨站请求在占用名额之前拒绝, 不升级为 websocket
+	if why, ok := rt.originPolicy().check(r); !ok {
+		logger.Warningf("Origin rejected: %s, %s %s, Session-Id:%s", why, clientIPString(r), r.URL.Path, _h)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
 
-	//处理掉一些加密过程中的特殊字符, 如空格 \r\n
-	_raddr = strings.TrimSpace(_raddr)
-
-	return ws, _raddr
-}
+	if !sessions.reserve(max_connections) {
+		rejectShake(w, r, _h, closeOverload)
+		return
+	}
+	if !vh.reserve() {
+		sessions.unreserve()
+		rejectShake(w, r, _h, closeOverload)
+		return
+	}
 
-func handles(w http.ResponseWriter, r *http.Request, pt string) {
-	var _t = time.Now()
-	var _h = hashCodes([]string{fmt.Sprintf("%s_%s", r.RemoteAddr, _t)})
+	var client *p_worker
+	defer func() {
+		// 后端连接失败, 归还握手时占用的名额
+		if client == nil {
+			sessions.unreserve()
+			vh.unreserve()
+		}
+	}()
 
-	ws, raddr := handleShake(w, r)
-	if ws == nil {
+	//多路复用路由的 token 在每个流的 OPEN 帧中
+	if pt == "mux" {
+		ws := handleShake(w, r, _h, nil, rt.subprotocols(), false)
+		if ws == nil {
+			return
+		}
+		client = &p_worker{key: _h, format: websocket.BinaryMessage, ws: ws,
+			proto: pt, raddr: "-", remote: r.RemoteAddr, since: _t, lb: lbInfoFrom(r), vhost: vh}
+		client.mux = newMuxSession(client, r, m)
+		go log(nil, ws, r, "", time.Since(_t), codeOK, _h).Out()
+		sessions.add(client)
+		client.start(pt)
 		return
-	} else if raddr == "" {
-		ws.Close()
+	}
+
+	var tk *tokenInfo
+	if rt.Token == tokenNone {
+		//由网关从后端组中选择, 上一跳网关指定的目标同样不用
+		tk = &tokenInfo{Addr: g.pick()}
+		if hop != nil {
+			tk.Claims = hop.token.Claims
+		}
+	} else {
+		if hop != nil {
+			//签名已验证, 直接使用其中的目标
+			tk = hop.token
+		} else if tk = requestToken(r, _h, rt.aesOnly(), vh.secrets()); tk == nil {
+			rejectShake(w, r, _h, closeBadToken)
+			return
+		}
+		if g != nil && !g.has(tk.Addr) {
+			logger.Warningf("Target %s not in group %s, %s %s, Session-Id:%s", tk.Addr, rt.Group, clientIPString(r), r.URL.Path, _h)
+			rejectShake(w, r, _h, closePolicy)
+			return
+		}
+	}
+	raddr := tk.Addr
+	if raddr == "" {
+		//SRV 组尚未解析出地址
+		logger.Warningf("No backend in group %s yet, %s %s, Session-Id:%s", rt.Group, clientIPString(r), r.URL.Path, _h)
+		rejectShake(w, r, _h, closeDialError)
 		return
 	}
 
-	var format int
-	switch cfgBuffFormat {
-	case "text":
-		format = websocket.TextMessage
-	case "bin":
-		format = websocket.BinaryMessage
-	default:
-		format = websocket.BinaryMessage
+	if !vh.allowed(raddr) {
+		logger.Warningf("Target %s not allowed on vhost %s, %s, Session-Id:%s", raddr, r.Host, clientIPString(r), _h)
+		rejectShake(w, r, _h, closePolicy)
+		return
 	}
 
-	var client = p_worker{}
-	switch pt {
-	case "wss":
+	var format = streamFormat()
+
+	zs := clientCompression(rt.compression())
+
+	switch {
+	case pt == "wss" || rt.NextHop != "":
 		//connect WS/WSS client
-		wc, _, err := websocket.DefaultDialer.Dial("ws://"+raddr+"/", w.Header())
+		//先连接后端, 后端握手响应中的 Set-Cookie、子协议等再回传给客户端
+		//配置了 next_hop 时连接下一跳网关, 两端之间按 websocket 消息原样转发
+		var b *BackendConf
+		var daddr, u string
+		var header http.Header
+		if rt.NextHop == "" {
+			b, daddr = findBackend(raddr), raddr
+			u, header = b.wsURL(tk), backendHeader(r, _h, tk)
+		} else {
+			b, daddr = findBackend(rt.nextAddr), rt.nextAddr
+			if u, header, err = rt.nextHopRequest(r, _h, tk, hop); err != nil {
+				logger.Errorf("Next hop %s: %s, Session-Id:%s", rt.NextHop, err, _h)
+				rejectShake(w, r, _h, closeDialError)
+				return
+			}
+		}
+		d := b.wsDialer(rt.dialConf())
+		d.Subprotocols = offeredSubprotocols(r)
+		zc := backendCompression(rt.compression())
+		d.EnableCompression = zc != nil
+		if up := rt.upstream(); up != nil {
+			d.Proxy = up.wsProxy
+		}
+		if rt.NextHop != "" {
+			ip, port := clientAddr(r)
+			chainDialer(d, rt.upstream().proxyFor(daddr), ip, port, _h)
+		}
+		var wc *websocket.Conn
+		var resp *http.Response
+		ctx, cancel := dialBudget(_t)
+		tries := 0
+		err := rt.retry().run(ctx, daddr, func(ctx context.Context) (err error) {
+			//内层 token 只能使用一次, 重试时重新生成 (第一次已成功生成过)
+			if tries++; tries > 1 && rt.NextHop != "" {
+				u, header, _ = rt.nextHopRequest(r, _h, tk, hop)
+			}
+			wc, resp, err = d.DialContext(ctx, u, header)
+			return err
+		})
+		cancel()
 		if err != nil {
-			//502 bad gateway
-			go log(nil, wc, r, raddr, time.Since(_t), codeDialErr, _h).Out()
-			ws.Close()
+			//502 bad gateway, 熔断中为 503
+			go log(nil, wc, r, raddr, time.Since(_t), dialErrorCode(err), _h).Out()
+			rejectShake(w, r, _h, dialErrorReason(err))
+			return
+		}
+
+		ws := handleShake(w, r, _h, relayHeader(resp), backendSubprotocol(wc), zs != nil)
+		if ws == nil {
+			wc.Close()
 			return
 		}
 
 		//add a worker
-		client = p_worker{_h, format, ws, wc, nil}
+		client = &p_worker{key: _h, format: format, ws: ws, wc: wc,
+			proto: pt, raddr: raddr, remote: r.RemoteAddr, since: _t, lb: lbInfoFrom(r), vhost: vh,
+			zs: newCompressLeg(ws, zs, r.Header), zc: newCompressLeg(wc, zc, resp.Header)}
 		//record a log
 		go log(nil, wc, r, raddr, time.Since(_t), codeOK, _h).Out()
 
 	default:
+		ws := handleShake(w, r, _h, nil, rt.subprotocols(), zs != nil)
+		if ws == nil {
+			return
+		}
+
 		//connect TCP/UDP client
-		sock, err := net.DialTimeout(pt, raddr, time.Duration(cfgDialTimeout))
-		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		var sock net.Conn
+		ctx, cancel := dialBudget(_t)
+		err := rt.retry().run(ctx, raddr, func(ctx context.Context) (err error) {
+			sock, err = rt.upstream().dial(ctx, rt.dialConf(), pt, raddr)
+			return err
+		})
+		cancel()
+		if isTimeout(err) {
 			//504 gateway timeout
 			go log(sock, nil, r, raddr, time.Since(_t), codeDialTimeout, _h).Out()
-			ws.Close()
+			closeWith(ws, closeDialTimeout)
 			return
 		}
 		if err != nil {
-			//502 bad gateway
-			go log(sock, nil, r, raddr, time.Since(_t), codeDialErr, _h).Out()
-			ws.Close()
+			//502 bad gateway, 熔断中为 503
+			go log(sock, nil, r, raddr, time.Since(_t), dialErrorCode(err), _h).Out()
+			closeWith(ws, dialErrorReason(err))
 			return
 		}
 
@@ -220,100 +336,170 @@ func handles(w http.ResponseWriter, r *http.Request, pt string) {
 		  //     server smtp 127.0.0.1:2319 send-proxy-v2 #IPV4 V2
 		  //
 		  // X-Forwarded-For 经过多层转发后，每被转发一次都会依次记录请求源地址
-		  // 只需要读取第一个字端，即是客户端的真实IP
+		  // 只有直连网关的对端是可信代理 (trusted_proxies) 时才读取，
+		  // 从右往左跳过可信代理，第一个不可信的地址即是客户端的真实IP
 		  //
-		  // PS: 直接请求网关时 X-Forwarded-For没有值，使用RemoteAddr函数，
-		  // 即可以获得真实IP。当 X-Forwarded-For 有值时，即用 X-Forwarded-For
-		  // 替换 RemoteAddr的值。
+		  // PS: 直接请求网关时使用RemoteAddr，客户端自己伪造的 X-Forwarded-For
+		  // 不会被采用。版本(v1/v2)与TLV按后端配置 backends 选择。
 		  **********************************************************/
-		if PProto == true {
-			x_real_ip := strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0]
-			x_localaddr := r.RemoteAddr
-			if x_real_ip != "" {
-				x_localaddr = strings.Replace(x_localaddr, "127.0.0.1", x_real_ip, -1)
-			}
+		if b := findBackend(raddr); b.ppVersion() > 0 {
 			// 连接TCP后端成功后，发送第一条信息为 proxy-protocol报文
-			send_proxyproto(sock, x_localaddr, raddr)
+			send_proxyproto(sock, r, pt, b, _h)
 		}
 
 		//add a worker
-		client = p_worker{_h, format, ws, nil, sock}
+		client = &p_worker{key: _h, format: format, ws: ws, sock: sock,
+			proto: pt, raddr: raddr, remote: r.RemoteAddr, since: _t, lb: lbInfoFrom(r), vhost: vh,
+			zs: newCompressLeg(ws, zs, r.Header)}
 		//record a log
 		go log(sock, nil, r, raddr, time.Since(_t), codeOK, _h).Out()
 	}
 
-	lock.Lock()
-	pool[client.key] = client
-	pool[client.key].start(pt)
-	lock.Unlock()
-}
-
-func send_proxyproto(c net.Conn, laddr, raddr string) bool {
-	l_addr, _ := net.ResolveTCPAddr("tcp", laddr)
-	r_addr, _ := net.ResolveTCPAddr("tcp", raddr)
-
-	_header := &proxyproto.Header{
-		Version:           1,
-		Command:           proxyproto.PROXY,
-		TransportProtocol: proxyproto.TCPv4,
-		SourceAddr:        l_addr,
-		DestinationAddr:   r_addr,
+	if m := client.lb.String(); m != "" {
+		logger.Infof("proxy header metadata: %s, Session-Id:%s", m, _h)
 	}
 
-	_, err := _header.WriteTo(c)
-	if err != nil {
-		logger.Errorf("Error: %s", err.Error())
-		return false
+	sessions.add(client)
+	client.start(If(rt.NextHop != "", "wss", pt).(string))
+}
+
+// -stream 指定的 TCP/UDP 数据帧类型
+func streamFormat() int {
+	switch cfgBuffFormat {
+	case "text":
+		return websocket.TextMessage
+	case "bin":
+		return websocket.BinaryMessage
+	default:
+		return websocket.BinaryMessage
 	}
-	return true
 }
 
-func aesDecrypt(encrypted string) string {
-	_a, err := aes256cbc.DecryptString(cfgSecret, encrypted)
-	if err != nil {
-		logger.Errorf("Decrypt an error occurred: %s, Encrypt: %s", err, encrypted)
-		return "__CANTNOT_DECRYPT__"
+// 依次尝试各个密钥, 便于密钥轮换
+func aesDecrypt(secrets []string, encrypted, sid string) string {
+	var err error
+	for _, secret := range secrets {
+		var _a string
+		if _a, err = aes256cbc.DecryptString(secret, encrypted); err == nil {
+			//错误的密钥偶尔也能通过填充校验, 解出的内容须是 token 格式
+			if plainToken(strings.TrimSpace(_a)) {
+				return _a
+			}
+			err = errors.New("not a valid token")
+		}
 	}
-	return _a
+	logger.Errorf("Decrypt an error occurred: %s, Encrypt: %s, Session-Id:%s", err, encrypted, sid)
+	return "__CANTNOT_DECRYPT__"
 }
 
-func tokenModel(aes bool, encrypted string) string {
+func tokenModel(aes bool, encrypted, sid string, secrets []string) string {
 	if aes == true {
-		return aesDecrypt(encrypted)
+		return aesDecrypt(secrets, encrypted, sid)
 	}
 
-	if len(strings.Split(encrypted, ":")) == 2 {
+	if plainToken(encrypted) {
 		return encrypted
-	} else {
-		return aesDecrypt(encrypted)
 	}
+	return aesDecrypt(secrets, encrypted, sid)
 }
 
-func (p p_worker) start(typ string) {
+// 明文token: host:port、[ipv6]:port 或 JSON (base64 密文中不会出现 ':' 与 '{')
+func plainToken(s string) bool {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return true
+	}
+	return strings.HasPrefix(s, "{")
+}
+
+func (p *p_worker) start(typ string) {
+	if typ == "mux" {
+		go p.mux.serve()
+		return
+	}
+
+	p.wait.Add(2)
+	p.ws.SetCloseHandler(p.holdClose)
 	if typ == "tcp" || typ == "udp" {
 		go p.frontend()
 		go p.backend()
+		go p.release_tup()
 
 	} else if typ == "wss" {
+		p.wc.SetCloseHandler(p.holdClose)
 		go p.upstream()
 		go p.downstream()
+		go p.release_wsp()
 	}
 }
 
-func (p p_worker) release_tup() {
+// 两个方向都结束后才释放连接
+func (p *p_worker) release_tup() {
+	p.wait.Wait()
 	p.ws.Close()
 	p.sock.Close()
-	lock.Lock()
-	delete(pool, p.key)
-	lock.Unlock()
+	p.zs.done()
+	p.vhost.unreserve()
+	sessions.remove(p)
 }
 
-func (p p_worker) release_wsp() {
+func (p *p_worker) release_wsp() {
+	p.wait.Wait()
 	p.ws.Close()
 	p.wc.Close()
-	lock.Lock()
-	delete(pool, p.key)
-	lock.Unlock()
+	p.zs.done()
+	p.zc.done()
+	p.vhost.unreserve()
+	sessions.remove(p)
+}
+
+// 异常时立即关闭两端, 使另一个方向的读取立刻返回
+func (p *p_worker) abort() {
+	p.ws.Close()
+	if p.sock != nil {
+		p.sock.Close()
+	}
+	if p.wc != nil {
+		p.wc.Close()
+	}
+}
+
+// 收到close帧时不立即回复, 等另一个方向排空后再回复
+func (p *p_worker) holdClose(code int, text string) error {
+	atomic.StoreInt32(&p.peerClose, int32(code))
+	return nil
+}
+
+// 半关闭: websocket close帧转成 TCP 的 CloseWrite()
+func (p *p_worker) closeWrite() bool {
+	c, ok := p.sock.(interface{ CloseWrite() error })
+	if !ok || c.CloseWrite() != nil {
+		return false
+	}
+	p.sock.SetReadDeadline(time.Now().Add(time.Duration(cfgDrainTimeout)))
+	return true
+}
+
+// 发送close帧, 对端已先关闭时回显对端的 close code
+func closeFrame(c *websocket.Conn, code int, text string) error {
+	return c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(time.Duration(cfgDialTimeout)))
+}
+
+// 对端确实发送了close帧 (gorilla 把异常断开也包装成 1006 CloseError)
+func closeReceived(err error) (*websocket.CloseError, bool) {
+	ce, ok := err.(*websocket.CloseError)
+	if !ok || ce.Code == websocket.CloseAbnormalClosure {
+		return nil, false
+	}
+	return ce, true
+}
+
+func (p *p_worker) closeCode() int {
+	if code := atomic.LoadInt32(&p.peerClose); code != 0 {
+		return int(code)
+	}
+	return websocket.CloseNormalClosure
 }
 
 // Websocket to Socket
@@ -339,6 +525,7 @@ func (p p_worker) release_wsp() {
 //
 // ***********************************************************/
 func (p *p_worker) frontend() {
+	defer p.wait.Done()
 	writer := bufio.NewWriter(p.sock)
 	for {
 		// Read from Websocket
@@ -350,54 +537,80 @@ func (p *p_worker) frontend() {
 				websocket.CloseGoingAway,
 				websocket.CloseNoStatusReceived) {
 
-				logger.Errorf("[Ws -> Sock] websocket read error: %s, User-Id:%s", err, p.key)
+				logger.Errorf("[Ws -> Sock] websocket read error: %s, Session-Id:%s", err, p.key)
 			} else {
 				//err close
-				logger.Noticef("%v, User-Id:%s", err, p.key)
+				logger.Noticef("%v, Session-Id:%s", err, p.key)
+			}
+
+			// 客户端发送了close帧, 只关闭TCP写方向, 后端的剩余数据继续回传
+			if _, ok := closeReceived(err); ok && p.closeWrite() {
+				return
 			}
 			break
 		}
+		p.zs.received(len(buf))
 
 		// Write to socket
 		n, err := writer.Write(buf)
+		if err == nil {
+			err = writer.Flush()
+		}
 		if err != nil || n < len(buf) {
-			logger.Warningf("[Ws -> Sock] socket write error: %s, User-Id:%s", err, p.key)
+			logger.Warningf("[Ws -> Sock] socket write error: %s, Session-Id:%s", err, p.key)
 			break
 		}
-		writer.Flush()
 	}
-	p.release_tup()
+	p.abort()
 }
 
 // Socket to Websocket
 func (p *p_worker) backend() {
+	defer p.wait.Done()
 	reader := bufio.NewReader(p.sock)
 	//buf := make([]byte, cfgBufferSize)
 	b := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(b)
 	buf := *b
 	for {
 		// Read from Socket
 		n, err := reader.Read(buf)
 		if err != nil {
 			if err == io.EOF {
-				logger.Noticef("[Sock -> Ws] socket read error '%s', User-Id:%s", err, p.key)
+				logger.Noticef("[Sock -> Ws] socket read error '%s', Session-Id:%s", err, p.key)
+			}
+
+			// 后端数据已全部写入websocket后再发送close帧,
+			// 客户端已先关闭时, 排空超时同样视为正常结束
+			if err == io.EOF || atomic.LoadInt32(&p.peerClose) != 0 {
+				if closeFrame(p.ws, p.closeCode(), "") == nil {
+					p.ws.SetReadDeadline(time.Now().Add(time.Duration(cfgDrainTimeout)))
+					return
+				}
+			}
+
+			// 后端被重置 (RST) 与正常结束区分开
+			if errors.Is(err, syscall.ECONNRESET) {
+				logger.Warningf("[Sock -> Ws] socket reset by backend, Session-Id:%s", p.key)
+				c := closeCodes[closeBackendReset]
+				closeFrame(p.ws, c.Code, c.Reason)
 			}
 			break
 		}
 
 		// Write to Websocket
-		err = p.ws.WriteMessage(p.format, buf[:n])
+		err = p.zs.write(p.ws, p.format, buf[:n])
 		if err != nil {
-			logger.Errorf("[Sock -> Ws] websocket write error: %s, User-Id:%s", err, p.key)
+			logger.Errorf("[Sock -> Ws] websocket write error: %s, Session-Id:%s", err, p.key)
 			break
 		}
 	}
-	copyBufPool.Put(b)
-	p.release_tup()
+	p.abort()
 }
 
 // WebsocketUP to websocketDOWN
 func (p *p_worker) upstream() {
+	defer p.wait.Done()
 	for {
 		// Read
 		_typ, buf, err := p.ws.ReadMessage()
@@ -408,40 +621,59 @@ func (p *p_worker) upstream() {
 				websocket.CloseGoingAway,
 				websocket.CloseNoStatusReceived) {
 
-				logger.Noticef("[Ws -> Wc] websocket read error: %v, User-Id:%s", err, p.key)
+				logger.Noticef("[Ws -> Wc] websocket read error: %v, Session-Id:%s", err, p.key)
 			} else {
 				//err close
-				logger.Noticef("%v, User-Id:%s", err, p.key)
+				logger.Noticef("%v, Session-Id:%s", err, p.key)
+			}
+
+			// 把客户端的close帧转发给后端, 等待后端回复close
+			if ce, ok := closeReceived(err); ok && closeFrame(p.wc, ce.Code, ce.Text) == nil {
+				p.wc.SetReadDeadline(time.Now().Add(time.Duration(cfgDrainTimeout)))
+				return
 			}
 			break
 		}
+		p.zs.received(len(buf))
 		// Write
-		err = p.wc.WriteMessage(_typ, buf)
+		err = p.zc.write(p.wc, _typ, buf)
 		if err != nil {
-			//logger.Errorf("[Ws -> Wc] websocket write error: %s, User-Id:%s", err, p.key)
+			//logger.Errorf("[Ws -> Wc] websocket write error: %s, Session-Id:%s", err, p.key)
 			break
 		}
 
 	}
-	p.release_wsp()
+	p.abort()
 }
 
 // WebsocketDOWN to websocketUP
 func (p *p_worker) downstream() {
+	defer p.wait.Done()
 	for {
 		// Read
 		_typ, buf, err := p.wc.ReadMessage()
 		if err != nil {
-			//logger.Noticef("[Wc -> Ws]websocket read error: %v, User-Id:%s", err, p.key)
+			//logger.Noticef("[Wc -> Ws]websocket read error: %v, Session-Id:%s", err, p.key)
+
+			// 把后端的close帧转发给客户端, 等待客户端回复close
+			if ce, ok := closeReceived(err); ok && closeFrame(p.ws, ce.Code, ce.Text) == nil {
+				p.ws.SetReadDeadline(time.Now().Add(time.Duration(cfgDrainTimeout)))
+				return
+			} else if !ok {
+				// 后端没有发送close帧就断开了
+				c := closeCodes[closeBackendReset]
+				closeFrame(p.ws, c.Code, c.Reason)
+			}
 			break
 		}
+		p.zc.received(len(buf))
 		// Write
-		err = p.ws.WriteMessage(_typ, buf)
+		err = p.zs.write(p.ws, _typ, buf)
 		if err != nil {
-			logger.Errorf("[Wc -> Ws] websocket write error: %s, User-Id:%s", err, p.key)
+			logger.Errorf("[Wc -> Ws] websocket write error: %s, Session-Id:%s", err, p.key)
 			break
 		}
 
 	}
-	p.release_wsp()
+	p.abort()
 }
@@ -1,41 +0,0 @@
-// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-// @Author: YWJT / ZhiQiang Koo
-// @Modify: 2023-03-03   
-//
-
-package main
-
-import (
-	"fmt"
-    "hash/crc32"
-    "bytes"
-)
-
-// String hashes a string to a unique hashcode.
-// crc32 returns a uint32, but for our use we need
-// and non negative integer. Here we cast to an integer
-// and invert it if the result is negative.
-func hashCode(s string) int {
-	v := int(crc32.ChecksumIEEE([]byte(s)))
-	if v >= 0 {
-		return v
-	}
-	if -v >= 0 {
-		return -v
-	}
-	// v == MinInt
-	return 0
-}
-
-// Strings hashes a list of strings to a unique hashcode.
-func hashCodes(strings []string) string {
-	var buf bytes.Buffer
-
-	for _, s := range strings {
-		buf.WriteString(fmt.Sprintf("%s-", s))
-	}
-
-	return fmt.Sprintf("%d", hashCode(buf.String()))
-}
@@ -0,0 +1,194 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ************************************************************
+// websocket 后端 (/ws) 的头部转发策略
+//
+//	"ws_headers": {
+//	  "pass":  ["Cookie", "Authorization", "Origin"], //透传客户端请求头, "*" 为全部
+//	  "strip": ["X-Internal-*"],                      //不透传, 支持前缀通配
+//	  "relay": ["Set-Cookie"],                        //后端握手响应回传给客户端
+//	  "claims_prefix": "X-Token-"                     //token claims 转为请求头的前缀
+//	}
+//
+// 网关另外添加 X-Forwarded-For/Proto/Host、X-Real-IP 与 X-Session-Id,
+// 客户端证书通过校验时添加 X-Client-Cert-Cn 与 X-Client-Cert-Subject。
+// 客户端发来的以 claims_prefix 开头的头部总是丢弃, 即使 pass 为 "*"
+// ************************************************************
+type HeaderConf struct {
+	Pass         []string `json:"pass"`
+	Strip        []string `json:"strip"`
+	Relay        []string `json:"relay"`
+	ClaimsPrefix string   `json:"claims_prefix"`
+}
+
+var defaultHeaders = &HeaderConf{
+	Pass:         []string{"Cookie", "Authorization", "Origin", "User-Agent", "Accept-Language"},
+	Relay:        []string{"Set-Cookie"},
+	ClaimsPrefix: "X-Token-",
+}
+
+// 逐跳头部、握手头部以及由网关自己生成的头部, 不透传
+var hopHeaders = map[string]bool{
+	"Host":                     true,
+	"Connection":               true,
+	"Upgrade":                  true,
+	"Keep-Alive":               true,
+	"Te":                       true,
+	"Trailer":                  true,
+	"Transfer-Encoding":        true,
+	"Content-Length":           true,
+	"Proxy-Authorization":      true,
+	"Proxy-Connection":         true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Protocol":   true, //子协议单独协商, 见 subprotocols.go
+	"Forwarded":                true,
+	"X-Forwarded-For":          true,
+	"X-Forwarded-Proto":        true,
+	"X-Forwarded-Host":         true,
+	"X-Real-Ip":                true,
+	sessionHeader:              true,
+	chainHopsHeader:            true,
+	chainViaHeader:             true,
+	chainAddrHeader:            true,
+	clientCNHeader:             true,
+	clientSubjectHeader:        true,
+}
+
+// 未配置的项使用默认值
+func (hc *HeaderConf) compile() {
+	if hc.Pass == nil {
+		hc.Pass = defaultHeaders.Pass
+	}
+	if hc.Relay == nil {
+		hc.Relay = defaultHeaders.Relay
+	}
+	if hc.ClaimsPrefix == "" {
+		hc.ClaimsPrefix = defaultHeaders.ClaimsPrefix
+	}
+}
+
+func wsHeaders() *HeaderConf {
+	if cfg.WSHeaders != nil {
+		return cfg.WSHeaders
+	}
+	return defaultHeaders
+}
+
+func headerListed(list []string, k string) bool {
+	for _, h := range list {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h == "*" || h == k {
+			return true
+		}
+		if strings.HasSuffix(h, "*") && strings.HasPrefix(k, strings.TrimSuffix(h, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// 发往 websocket 后端的请求头
+func backendHeader(r *http.Request, sid string, tk *tokenInfo) http.Header {
+	hc := wsHeaders()
+	h := http.Header{}
+
+	//claims 前缀的头部只能由网关根据 token 生成, 客户端发来的一律丢弃
+	claimsPrefix := http.CanonicalHeaderKey(hc.ClaimsPrefix)
+	for k, vs := range r.Header {
+		if hopHeaders[k] || strings.HasPrefix(k, claimsPrefix) {
+			continue
+		}
+		if !headerListed(hc.Pass, k) || headerListed(hc.Strip, k) {
+			continue
+		}
+		h[k] = vs
+	}
+
+	// 直连对端是可信代理时沿用它给出的转发信息, 否则以网关看到的为准
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	trusted := trustedPeer(r, net.ParseIP(peer))
+
+	xff := peer
+	if prior := r.Header.Get("X-Forwarded-For"); trusted && prior != "" {
+		//unix socket 对端没有地址
+		xff = If(peer == "", prior, prior+", "+peer).(string)
+	}
+	proto := If(r.TLS != nil, "https", "http").(string)
+	if p := r.Header.Get("X-Forwarded-Proto"); trusted && p != "" {
+		proto = p
+	}
+	host := r.Host
+	if x := r.Header.Get("X-Forwarded-Host"); trusted && x != "" {
+		host = x
+	}
+
+	h.Set("X-Forwarded-For", xff)
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", host)
+	h.Set("X-Real-IP", clientIPString(r))
+	h.Set(sessionHeader, sid)
+
+	//通过校验的客户端证书
+	if id := peerIdentity(r); id != nil {
+		h.Set(clientCNHeader, id.cn)
+		h.Set(clientSubjectHeader, id.subject)
+	}
+
+	for k, v := range tk.Claims {
+		if !validHeaderName(k) {
+			continue
+		}
+		name := http.CanonicalHeaderKey(hc.ClaimsPrefix + k)
+		if hopHeaders[name] {
+			continue
+		}
+		h.Set(name, strings.NewReplacer("\r", "", "\n", "").Replace(v))
+	}
+	return h
+}
+
+// 后端握手响应中需要回传给客户端的头部
+func relayHeader(resp *http.Response) http.Header {
+	h := http.Header{}
+	if resp == nil {
+		return h
+	}
+	hc := wsHeaders()
+	for k, vs := range resp.Header {
+		if hopHeaders[k] {
+			continue
+		}
+		if headerListed(hc.Relay, k) && !headerListed(hc.Strip, k) {
+			h[k] = vs
+		}
+	}
+	return h
+}
+
+func validHeaderName(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/aes256cbc"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlainTokenClaimsDropped(t *testing.T) {
+	tk := decodeToken(`{"addr": "10.0.0.1:9000", "claims": {"uid": "admin"}}`, "sid", false, []string{"k"})
+	if tk == nil || tk.Addr != "10.0.0.1:9000" {
+		t.Fatalf("decodeToken = %+v", tk)
+	}
+	if tk.Claims != nil {
+		t.Fatalf("plain token claims forwarded: %v", tk.Claims)
+	}
+
+	enc, err := aes256cbc.EncryptString("k", `{"addr": "10.0.0.1:9000", "claims": {"uid": "42"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk = decodeToken(enc, "sid", false, []string{"k"})
+	if tk == nil || tk.Claims["uid"] != "42" {
+		t.Fatalf("encrypted token claims lost: %+v", tk)
+	}
+}
+
+func TestClientClaimsHeaderStripped(t *testing.T) {
+	saved := cfg.WSHeaders
+	defer func() { cfg.WSHeaders = saved }()
+	cfg.WSHeaders = &HeaderConf{Pass: []string{"*"}}
+	cfg.WSHeaders.compile()
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("X-Token-Uid", "admin")
+	r.Header.Set("X-Other", "1")
+	h := backendHeader(r, "sid", &tokenInfo{Addr: "10.0.0.1:9000"})
+	if v := h.Get("X-Token-Uid"); v != "" {
+		t.Fatalf("client X-Token-Uid passed through: %q", v)
+	}
+	if h.Get("X-Other") != "1" {
+		t.Fatalf("X-Other not passed with pass \"*\"")
+	}
+
+	h = backendHeader(r, "sid", &tokenInfo{Addr: "10.0.0.1:9000", Claims: map[string]string{"uid": "42"}})
+	if v := h.Values("X-Token-Uid"); len(v) != 1 || v[0] != "42" {
+		t.Fatalf("X-Token-Uid = %v, want [42]", v)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// 转发给 websocket 后端的客户端证书头部
+const (
+	clientCNHeader      = "X-Client-Cert-Cn"
+	clientSubjectHeader = "X-Client-Cert-Subject"
+)
+
+// 通过校验的客户端证书身份
+type clientIdentity struct {
+	cn      string
+	subject string
+	names   []string //SAN 中的 DNS、email、URI
+}
+
+// 只取通过校验的证书, 未提供或未校验 (client_auth request) 时返回 nil
+func peerIdentity(r *http.Request) *clientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	c := r.TLS.VerifiedChains[0][0]
+	id := &clientIdentity{cn: c.Subject.CommonName, subject: c.Subject.String()}
+	id.names = append(id.names, c.DNSNames...)
+	id.names = append(id.names, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		id.names = append(id.names, u.String())
+	}
+	return id
+}
+
+// ************************************************************
+// 身份匹配, CN 或任意一个 SAN 命中即可
+//
+//	"*"                       任意通过校验的证书
+//	"device-*"                前缀
+//	"*.fleet.example.com"     后缀
+//	"spiffe://fleet/gw"       完整匹配
+//
+// ************************************************************
+func (id *clientIdentity) matches(patterns []string) bool {
+	if id == nil {
+		return false
+	}
+	for _, p := range patterns {
+		if p == "*" {
+			return true
+		}
+		if id.match(p, id.cn) {
+			return true
+		}
+		for _, n := range id.names {
+			if id.match(p, n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (id *clientIdentity) match(p, name string) bool {
+	if name == "" {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(p, "*"):
+		return strings.HasSuffix(strings.ToLower(name), strings.ToLower(p[1:]))
+	case strings.HasSuffix(p, "*"):
+		return strings.HasPrefix(strings.ToLower(name), strings.ToLower(p[:len(p)-1]))
+	}
+	return strings.EqualFold(p, name)
+}
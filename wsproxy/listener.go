@@ -10,30 +10,120 @@ package main
 import (
     "fmt"
     "context"
+    "crypto/tls"
 	"net/http"
 	"os"
 	"os/signal"
     "syscall"
     "io/ioutil"
     "strconv"
+    "net"
+    "proxyproto"
+    "strings"
+
+    tcpserver "github.com/orkunkaraduman/go-tcpserver"
 )
 
 
+// ************************************************************
+// 监听地址, 可以同时提供 ws:// 与 wss://
+//
+//  "listeners": [
+//    {"addr": "0.0.0.0:80"},
+//    {"addr": "0.0.0.0:443", "tls": {"cert": "cert.pem", "key": "key.pem"}},
+//    {"addr": "unix:/run/wsproxy.sock", "routes": ["/ws"]}
+//  ],
+//  "admin": "127.0.0.1:9090"
+//
+//  addr:   host:port 或 unix:/path (供本机 nginx 等使用, 视为可信代理)
+//  tls:    配置后为 wss, 虚拟主机的证书按 SNI 优先, 客户端证书校验见 tlsconf.go
+//  routes: 本监听地址开放的路由 (routes 中的 path), 未配置时全部开放
+//  admin:  /status /ok /sessions /metrics 单独监听, 只能是本机地址;
+//          所有监听地址都提供 /ok 与 /status (健康检查), 会话与后端地址只在管理端口
+//
+// 未配置 listeners 时使用 -addr 与 -ssl_only
+// ************************************************************
+type ListenerConf struct {
+    Addr   string           `json:"addr"`
+    TLS    *ListenerTLSConf `json:"tls"`
+    Routes []string         `json:"routes"`
+
+    network string
+    address string
+    routes  map[string]bool
+}
+
+func (l *ListenerConf) compile() error {
+    if strings.HasPrefix(l.Addr, "unix:") {
+        l.network, l.address = "unix", strings.TrimPrefix(l.Addr, "unix:")
+        if l.address == "" {
+            return fmt.Errorf("empty unix socket path")
+        }
+    } else {
+        if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+            return err
+        }
+        l.network, l.address = "tcp", l.Addr
+    }
+
+    if l.TLS != nil {
+        if err := l.TLS.compile(); err != nil {
+            return fmt.Errorf("tls: %s", err)
+        }
+    }
+
+    l.routes = nil
+    if len(l.Routes) > 0 {
+        l.routes = make(map[string]bool)
+        for _, p := range l.Routes {
+            l.routes[p] = true
+        }
+    }
+    return nil
+}
+
+func (l *ListenerConf) String() string {
+    return l.Addr + If(l.TLS != nil, " (tls)", "").(string)
+}
+
+// 管理端口只能监听本机地址
+func checkAdminAddr(addr string) error {
+    if strings.HasPrefix(addr, "unix:") {
+        return nil
+    }
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+        return fmt.Errorf("'%s' is not a loopback address", addr)
+    }
+    return nil
+}
+
+type listenerKey struct{}
+
+// 请求是否来自 unix socket 监听地址
+func unixPeer(r *http.Request) bool {
+    l, ok := r.Context().Value(listenerKey{}).(*ListenerConf)
+    return ok && l.network == "unix"
+}
+
 type Server struct {
-    cert string
-    key  string
-    tls_mod  bool
-    srv *http.Server
-    info string
+    listeners []*ListenerConf
+    admin     string
+    srvs      []*http.Server
+    tunnels   []*TunnelConf
+    tcps      []*tcpserver.TCPServer
+    info      string
 }
 
 // 创建一个server的接口
-func NewServer(ip_port string, cert_pem string, key_pem string, tls_mod bool, info string) *Server {
+func NewServer(listeners []*ListenerConf, admin string, tunnels []*TunnelConf, info string) *Server {
     server := &Server{
-        cert: cert_pem,
-        key:  key_pem,
-        tls_mod: tls_mod,
-        srv: &http.Server{Addr: ip_port},
+        listeners: listeners,
+        admin: admin,
+        tunnels: tunnels,
         info: info,
     }
     return server
@@ -50,30 +140,117 @@ func (s *Server) start() {
 		<-sigint
 
 		// We received an interrupt signal, shut down.
-		if err := s.srv.Shutdown(context.Background()); err != nil {
-			// Error from closing listeners, or context timeout:
-			fmt.Printf("HTTP server Shutdown: %v\n", err)
-            CloseSignal()
+		for _, srv := range s.srvs {
+			if err := srv.Shutdown(context.Background()); err != nil {
+				// Error from closing listeners, or context timeout:
+				fmt.Printf("HTTP server Shutdown: %v\n", err)
+				CloseSignal()
+			}
+		}
+		// 隧道连接收到 closeCh 后立即断开
+		for _, srv := range s.tcps {
+			srv.Shutdown(context.Background())
 		}
 		close(idleConnsClosed)
 		CloseSignal()
         fmt.Printf("WSproxy killed\n")
 	}()
 
-    if s.tls_mod {
-        go s.l_https()
-    }else{
-        go s.l_http()
+    for _, l := range s.listeners {
+        s.srvs = append(s.srvs, s.serve(l))
+    }
+    if s.admin != "" {
+        s.srvs = append(s.srvs, s.serveAdmin())
     }
+    s.tcps = serveTunnels(s.tunnels)
     
-    fmt.Printf(s.info)
+    fmt.Print(s.info)
 	<-idleConnsClosed
 }
 
 
+// 监听端口, 前面有L4负载均衡时按配置解析 PROXY 协议头
+// 最内层统计收发字节数, 用于计算压缩率
+func listen(network, address string) (net.Listener, error) {
+    if network == "unix" {
+        // 清理上次退出时遗留的 socket 文件
+        if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+            os.Remove(address)
+        }
+    }
+    ln, err := net.Listen(network, address)
+    if err != nil {
+        return nil, err
+    }
+    ln = meteredListener{ln}
+    if policy := acceptPPPolicy(); policy != nil {
+        ln = &proxyproto.Listener{Listener: ln, Policy: policy}
+    }
+    return ln, nil
+}
+
+// 每个监听地址一个 http.Server
+func (s *Server) serve(l *ListenerConf) *http.Server {
+    mux := http.NewServeMux()
+    publicRoutes(mux)
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        serveRoute(w, r, l.routes)
+    })
+
+    srv := &http.Server{
+        Handler: mux,
+        ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+            return ppConnContext(context.WithValue(ctx, listenerKey{}, l), c)
+        },
+    }
+    if l.TLS != nil {
+        // 不启用 HTTP/2, websocket 握手只走 HTTP/1.1
+        srv.TLSConfig = l.TLS.config
+        srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+        go l.TLS.reloadLoop(l.Addr)
+        if l.TLS.dir != nil {
+            go l.TLS.dir.watch()
+        }
+        if l.TLS.Dev && l.TLS.Cert == "" {
+            logger.Warningf("%s is using a self-signed development certificate", l.Addr)
+        }
+        go l_https(srv, l)
+    } else {
+        go l_http(srv, l)
+    }
+    return srv
+}
+
+// 管理端口, 不经过路由表
+func (s *Server) serveAdmin() *http.Server {
+    mux := http.NewServeMux()
+    adminRoutes(mux)
+    srv := &http.Server{Handler: mux}
+
+    l := &ListenerConf{Addr: s.admin}
+    if err := l.compile(); err == nil {
+        go func() {
+            ln, err := net.Listen(l.network, l.address)
+            if err == nil {
+                err = srv.Serve(ln)
+            }
+            if err != http.ErrServerClosed {
+                fmt.Println("")
+                fmt.Printf("Admin Server Listen Err: \"%s\"\n", err.Error())
+                CloseSignal()
+            }
+        }()
+    }
+    return srv
+}
+
 // listen http
-func (s *Server) l_http() {
-    if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+func l_http(srv *http.Server, l *ListenerConf) {
+    ln, err := listen(l.network, l.address)
+    if err == nil {
+        err = srv.Serve(ln)
+    }
+    if err != http.ErrServerClosed {
         fmt.Println("")
 		fmt.Printf("HTTP Server Listen Err: \"%s\"\n", err.Error())
         CloseSignal()
@@ -81,8 +258,14 @@ func (s *Server) l_http() {
 }
 
 // listen https
-func (s *Server) l_https() {
-    if err := s.srv.ListenAndServeTLS(s.cert, s.key); err != http.ErrServerClosed {
+func l_https(srv *http.Server, l *ListenerConf) {
+    ln, err := listen(l.network, l.address)
+    if err == nil {
+        // 证书已在 TLSConfig 中 (见 tlsconf.go)
+        // 不用 ServeTLS: 它会复制一份 TLSConfig, 之后轮换的 ticket 密钥不会生效
+        err = srv.Serve(tls.NewListener(ln, l.TLS.config))
+    }
+    if err != http.ErrServerClosed {
         fmt.Println("")
 		fmt.Printf("HTTPS Server Listen Err: \"%s\"\n", err.Error())
         CloseSignal()
@@ -36,7 +36,7 @@ func init() {
 type LogStruck struct {
     // Log Fromat:
     // $request_time $remote_addr "$server_addr:$server_port -> $target_addr:$target_port" \
-    //                           "$request" $status "$http_user_agent" $x_real_ip $http_x_forwarded_for $hashcode
+    //                           "$request" $status "$http_user_agent" $x_real_ip $http_x_forwarded_for $session_id
     request_time     time.Duration
     remote_addr      string
     server_addr_port string
@@ -46,12 +46,12 @@ type LogStruck struct {
     http_user_agent  string
 	http_x_real_ip   string
     http_x_forwarded_for string
-    hashcode         string
+    session_id       string
 }
 
 //记录一条请求日志集
 func (logh *LogStruck) Out() {
-    logger.Infof("%v %s \"net:%s->%s\" \"%s\" %s \"%s\" %s %s \"User-Id:%s\"", 
+    logger.Infof("%v %s \"net:%s->%s\" \"%s\" %s \"%s\" %s %s \"Session-Id:%s\"", 
                logh.request_time,
                logh.remote_addr,
                logh.server_addr_port,
@@ -61,13 +61,13 @@ func (logh *LogStruck) Out() {
                logh.http_user_agent,
                logh.http_x_forwarded_for,
                logh.http_x_real_ip,
-               logh.hashcode)
+               logh.session_id)
 }
 
 
-func log(c net.Conn, wc *websocket.Conn, r *http.Request, raddr string, runTime time.Duration, stCode int, hashCode string) *LogStruck {
+func log(c net.Conn, wc *websocket.Conn, r *http.Request, raddr string, runTime time.Duration, stCode int, sessionId string) *LogStruck {
     var local_addr = ""
-    x_real_ip := r.Header.Get("X-Real-IP")
+    x_real_ip := clientIPString(r)
     x_forwarded_for := r.Header.Get("X-Forwarded-For")
     user_agent := r.Header.Get("User-Agent")
     
@@ -86,7 +86,7 @@ func log(c net.Conn, wc *websocket.Conn, r *http.Request, raddr string, runTime
     request    := fmt.Sprintf("%s %s %s %s", r.Host, r.Method, r.RequestURI, r.Proto)
     status     := strconv.Itoa(stCode)
     http_user_agent := If(user_agent=="", "-", user_agent).(string)
-    hashcode   := If(hashCode=="", "-", hashCode).(string)
+    session_id := If(sessionId=="", "-", sessionId).(string)
     
     return &LogStruck{request_time, 
                        remote_addr, 
@@ -96,6 +96,6 @@ func log(c net.Conn, wc *websocket.Conn, r *http.Request, raddr string, runTime
                        http_user_agent, 
                        http_x_real_ip, 
                        http_x_forwarded_for, 
-                       hashcode}
+                       session_id}
 
 }
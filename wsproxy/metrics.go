@@ -0,0 +1,84 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"proxyproto"
+	"sync/atomic"
+)
+
+// 运行指标, 由 /metrics 输出
+var metrics struct {
+	compressPayload int64 //协商了压缩的连接上收发的消息字节数 (解压后)
+	compressWire    int64 //同一批连接上实际收发的字节数 (含帧头)
+	dialRetries     int64 //连接后端的重试次数
+	breakerRejected int64 //熔断器断开期间放弃的连接尝试
+}
+
+// 压缩率: 线路字节数 / 消息字节数, 没有压缩连接时为 0
+func compressRatio() float64 {
+	payload := atomic.LoadInt64(&metrics.compressPayload)
+	if payload == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&metrics.compressWire)) / float64(payload)
+}
+
+// ************************************************************
+// 统计收发字节数的连接
+//
+// 客户端连接在监听端口包装 (在 PROXY 协议与 TLS 之下),
+// websocket 后端连接在拨号时包装, 握手后通过 UnderlyingConn() 取回
+// ************************************************************
+type meteredConn struct {
+	net.Conn
+	rx int64
+	tx int64
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.rx, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.tx, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) total() int64 {
+	return atomic.LoadInt64(&c.rx) + atomic.LoadInt64(&c.tx)
+}
+
+type meteredListener struct {
+	net.Listener
+}
+
+func (l meteredListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &meteredConn{Conn: c}, nil
+}
+
+// 从 websocket 底层连接中找到计数连接, 没有时返回 nil
+func meterOf(c net.Conn) *meteredConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		c = pc.Raw()
+	}
+	mc, _ := c.(*meteredConn)
+	return mc
+}
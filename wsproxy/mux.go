@@ -0,0 +1,472 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ************************************************************
+// 多路复用路由: 一个 websocket 上同时承载多个到不同后端的流
+//
+//	"routes": [
+//	  {"path": "/mux", "proto": "mux", "group": "db", "mux": {"window": 262144, "max_streams": 256}}
+//	]
+//
+//	window:      每个流每个方向的初始窗口 (字节), 默认 256K
+//	max_streams: 一个连接上同时打开的流, 默认 256
+//
+// 每个 websocket 二进制消息是一帧: 类型(1字节) + 流ID(4字节, 大端) + 负载
+//
+//	OPEN   1  客户端: 网络(1字节, 0 tcp / 1 udp) + token; 网关: 连接成功时回复, 负载为空
+//	DATA   2  数据, 不能超过对端剩余的窗口; udp 流每帧一个数据报
+//	CLOSE  3  本方向不再发送数据 (TCP 半关闭), 两个方向都关闭后流结束
+//	RESET  4  立即中止流, 负载为 close code(2字节) + 原因, 与 close_codes 相同
+//	WINDOW 5  增加对端的发送窗口, 负载为增量(4字节)
+//
+// 流ID由客户端选择, 不能为 0, 流结束后可以重用。
+// 每个流的 token 与 ?token= 格式相同, 按路由的 token 模式解码,
+// 同样受后端组与虚拟主机限制; token 为 none 的路由 OPEN 负载中不带 token, 从组内选择后端。
+// 双方的初始窗口都是 window, 网关把数据写入后端后以 WINDOW 归还额度,
+// 客户端超出窗口时网关以 RESET (policy) 中止该流。
+// 整个连接占用一个 -max_conns 名额, 日志中流的会话ID为 <Session-Id>/<流ID>。
+// ************************************************************
+type MuxConf struct {
+	Window     int `json:"window"`
+	MaxStreams int `json:"max_streams"`
+}
+
+var defaultMux = &MuxConf{Window: 256 << 10, MaxStreams: 256}
+
+func (mc *MuxConf) compile() error {
+	if mc.Window < 0 || mc.MaxStreams < 0 {
+		return fmt.Errorf("window/max_streams must not be negative")
+	}
+	if mc.Window == 0 {
+		mc.Window = defaultMux.Window
+	}
+	if mc.MaxStreams == 0 {
+		mc.MaxStreams = defaultMux.MaxStreams
+	}
+	return nil
+}
+
+func (rt *RouteConf) mux() *MuxConf {
+	if rt.Mux != nil {
+		return rt.Mux
+	}
+	return defaultMux
+}
+
+const (
+	muxOpen   = 1
+	muxData   = 2
+	muxClose  = 3
+	muxReset  = 4
+	muxWindow = 5
+
+	muxHeaderLen = 5
+)
+
+var muxNetworks = []string{"tcp", "udp"}
+
+type muxSession struct {
+	p    *p_worker
+	r    *http.Request
+	m    *routeMatch
+	conf *MuxConf
+
+	wmu sync.Mutex //gorilla 只允许一个并发写
+
+	ctx    context.Context //连接断开时取消, 正在连接后端的流随之放弃
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+}
+
+type muxStream struct {
+	id      uint32
+	s       *muxSession
+	key     string //日志中的会话ID
+	network string
+	since   time.Time
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	sock   net.Conn //连接成功之前为 nil
+	queue  [][]byte //客户端发来、尚未写入后端的数据
+	queued int      //其中的字节数, 不能超过窗口
+	window int      //还可以发给客户端的字节数
+	fin    bool     //客户端已发送 CLOSE
+	done   int      //已结束的方向
+	ended  bool
+}
+
+func newMuxSession(p *p_worker, r *http.Request, m *routeMatch) *muxSession {
+	s := &muxSession{p: p, r: r, m: m, conf: m.route.mux(), streams: make(map[uint32]*muxStream)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// 读取客户端的帧, 连接断开后中止所有流
+func (s *muxSession) serve() {
+	ws := s.p.ws
+	ws.SetReadLimit(int64(muxHeaderLen + s.conf.Window))
+	for {
+		typ, msg, err := ws.ReadMessage()
+		if err != nil {
+			logger.Noticef("[Mux] %v, Session-Id:%s", err, s.p.key)
+			break
+		}
+		if typ != websocket.BinaryMessage || len(msg) < muxHeaderLen {
+			logger.Warningf("[Mux] malformed frame, Session-Id:%s", s.p.key)
+			closeWith(ws, closePolicy)
+			break
+		}
+		if !s.handle(msg[0], binary.BigEndian.Uint32(msg[1:]), msg[muxHeaderLen:]) {
+			closeWith(ws, closePolicy)
+			break
+		}
+	}
+	s.release()
+}
+
+// 处理一帧, 违反协议时返回 false
+func (s *muxSession) handle(typ byte, id uint32, payload []byte) bool {
+	if id == 0 {
+		logger.Warningf("[Mux] stream id 0, Session-Id:%s", s.p.key)
+		return false
+	}
+	if typ == muxOpen {
+		s.open(id, payload)
+		return true
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	//流刚刚结束时对端可能还有帧在路上, 忽略
+	if st == nil {
+		return true
+	}
+
+	switch typ {
+	case muxData:
+		st.received(payload)
+	case muxClose:
+		st.mu.Lock()
+		st.fin = true
+		st.cond.Broadcast()
+		st.mu.Unlock()
+	case muxReset:
+		st.end()
+	case muxWindow:
+		if len(payload) != 4 {
+			return false
+		}
+		st.mu.Lock()
+		st.window += int(binary.BigEndian.Uint32(payload))
+		st.cond.Broadcast()
+		st.mu.Unlock()
+	default:
+		logger.Warningf("[Mux] unknown frame type %d, Session-Id:%s", typ, s.p.key)
+		return false
+	}
+	return true
+}
+
+func (s *muxSession) send(typ byte, id uint32, payload []byte) error {
+	b := make([]byte, muxHeaderLen+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	copy(b[muxHeaderLen:], payload)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.p.ws.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// 以 close_codes 中的 code 与原因中止流
+func (s *muxSession) reset(id uint32, reason string) {
+	c := closeCodes[reason]
+	b := binary.BigEndian.AppendUint16(nil, uint16(c.Code))
+	s.send(muxReset, id, append(b, c.Reason...))
+}
+
+func (s *muxSession) open(id uint32, payload []byte) {
+	s.mu.Lock()
+	_, dup := s.streams[id]
+	full := len(s.streams) >= s.conf.MaxStreams
+	if dup || full || len(payload) < 1 || int(payload[0]) >= len(muxNetworks) {
+		s.mu.Unlock()
+		logger.Warningf("[Mux] stream %d rejected (duplicate %v, full %v), Session-Id:%s", id, dup, full, s.p.key)
+		if !dup {
+			s.reset(id, If(full, closeOverload, closePolicy).(string))
+		}
+		return
+	}
+	st := &muxStream{id: id, s: s, key: s.p.key + "/" + strconv.FormatUint(uint64(id), 10),
+		network: muxNetworks[payload[0]], since: time.Now(), window: s.conf.Window}
+	st.cond = sync.NewCond(&st.mu)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	go st.dial(string(payload[1:]))
+}
+
+func (s *muxSession) release() {
+	s.cancel()
+	s.mu.Lock()
+	var all []*muxStream
+	for _, st := range s.streams {
+		all = append(all, st)
+	}
+	s.mu.Unlock()
+	for _, st := range all {
+		st.end()
+	}
+
+	s.p.ws.Close()
+	s.p.vhost.unreserve()
+	sessions.remove(s.p)
+}
+
+// 按流的 token 选择并连接后端, 检查与 handles 相同
+func (st *muxStream) dial(token string) {
+	s := st.s
+	rt, g, vh, r := s.m.route, s.m.group, s.m.vhost, s.r
+
+	var tk *tokenInfo
+	if rt.Token == tokenNone {
+		tk = &tokenInfo{Addr: g.pick()}
+	} else if tk = decodeToken(token, st.key, rt.aesOnly(), vh.secrets()); tk == nil {
+		st.fail(closeBadToken)
+		return
+	}
+	raddr := tk.Addr
+	if raddr == "" {
+		//SRV 组尚未解析出地址
+		logger.Warningf("[Mux] no backend in group %s yet, Session-Id:%s", rt.Group, st.key)
+		st.fail(closeDialError)
+		return
+	}
+	if g != nil && !g.has(raddr) || !vh.allowed(raddr) {
+		logger.Warningf("[Mux] target %s not allowed, %s, Session-Id:%s", raddr, clientIPString(r), st.key)
+		st.fail(closePolicy)
+		return
+	}
+
+	//与 dialBudget 相同的期限, 但连接断开时一并取消
+	var sock net.Conn
+	ctx, cancel := context.WithDeadline(s.ctx, st.since.Add(time.Duration(cfgDialTimeout)))
+	err := rt.retry().run(ctx, raddr, func(ctx context.Context) (err error) {
+		sock, err = rt.upstream().dial(ctx, rt.dialConf(), st.network, raddr)
+		return err
+	})
+	cancel()
+	if err != nil && s.ctx.Err() != nil {
+		//连接已断开, 流已在 release 中结束
+		return
+	}
+	if err != nil {
+		code, reason := dialErrorCode(err), dialErrorReason(err)
+		if isTimeout(err) {
+			code, reason = codeDialTimeout, closeDialTimeout
+		}
+		go log(nil, nil, r, raddr, time.Since(st.since), code, st.key).Out()
+		st.fail(reason)
+		return
+	}
+	if b := findBackend(raddr); b.ppVersion() > 0 {
+		send_proxyproto(sock, r, st.network, b, st.key)
+	}
+
+	st.mu.Lock()
+	if st.ended {
+		//连接期间客户端已中止
+		st.mu.Unlock()
+		sock.Close()
+		return
+	}
+	st.sock = sock
+	st.mu.Unlock()
+
+	go log(sock, nil, r, raddr, time.Since(st.since), codeOK, st.key).Out()
+	if s.send(muxOpen, st.id, nil) != nil {
+		st.end()
+		return
+	}
+	go st.writer()
+	go st.reader()
+}
+
+// 客户端数据, 超出窗口时中止流
+func (st *muxStream) received(b []byte) {
+	st.mu.Lock()
+	if st.ended {
+		st.mu.Unlock()
+		return
+	}
+	if st.fin || st.queued+len(b) > st.s.conf.Window {
+		st.mu.Unlock()
+		logger.Warningf("[Mux] stream %d flow control violation, Session-Id:%s", st.id, st.s.p.key)
+		st.fail(closePolicy)
+		return
+	}
+	st.queue = append(st.queue, b)
+	st.queued += len(b)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// 客户端 -> 后端, 写入后归还窗口
+func (st *muxStream) writer() {
+	for {
+		st.mu.Lock()
+		for len(st.queue) == 0 && !st.fin && !st.ended {
+			st.cond.Wait()
+		}
+		if st.ended {
+			st.mu.Unlock()
+			return
+		}
+		if len(st.queue) == 0 {
+			st.mu.Unlock()
+			//TCP 半关闭, UDP 没有半关闭, 直接结束
+			if c, ok := st.sock.(interface{ CloseWrite() error }); ok && c.CloseWrite() == nil {
+				st.finish()
+			} else {
+				st.s.send(muxClose, st.id, nil)
+				st.end()
+			}
+			return
+		}
+		b := st.queue[0]
+		st.queue[0] = nil
+		st.queue = st.queue[1:]
+		st.mu.Unlock()
+
+		if _, err := st.sock.Write(b); err != nil {
+			logger.Warningf("[Mux] stream %d write error: %s, Session-Id:%s", st.id, err, st.s.p.key)
+			st.fail(closeBackendReset)
+			return
+		}
+		st.mu.Lock()
+		st.queued -= len(b)
+		st.mu.Unlock()
+		if st.s.send(muxWindow, st.id, binary.BigEndian.AppendUint32(nil, uint32(len(b)))) != nil {
+			st.end()
+			return
+		}
+	}
+}
+
+// 后端 -> 客户端, 只发送窗口允许的数据
+func (st *muxStream) reader() {
+	b := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(b)
+	buf := *b
+	for {
+		st.mu.Lock()
+		for st.window <= 0 && !st.ended {
+			st.cond.Wait()
+		}
+		if st.ended {
+			st.mu.Unlock()
+			return
+		}
+		n := len(buf)
+		//UDP 数据报不能截断, 窗口不足时允许暂时透支
+		if st.network == "tcp" && st.window < n {
+			n = st.window
+		}
+		st.mu.Unlock()
+
+		n, err := st.sock.Read(buf[:n])
+		if n > 0 {
+			st.mu.Lock()
+			st.window -= n
+			st.mu.Unlock()
+			if st.s.send(muxData, st.id, buf[:n]) != nil {
+				st.end()
+				return
+			}
+		}
+		if err != nil {
+			st.mu.Lock()
+			ended := st.ended
+			st.mu.Unlock()
+			if ended {
+				return
+			}
+		}
+		if err == io.EOF {
+			st.s.send(muxClose, st.id, nil)
+			st.finish()
+			return
+		}
+		if err != nil {
+			st.fail(closeBackendReset)
+			return
+		}
+	}
+}
+
+// 一个方向正常结束, 两个方向都结束后释放
+func (st *muxStream) finish() {
+	st.mu.Lock()
+	st.done++
+	last := st.done == 2
+	st.mu.Unlock()
+	if last {
+		st.end()
+	}
+}
+
+// 网关中止流并通知客户端
+func (st *muxStream) fail(reason string) {
+	if st.end() {
+		st.s.reset(st.id, reason)
+	}
+}
+
+// 释放流, 只有第一次调用返回 true
+func (st *muxStream) end() bool {
+	st.mu.Lock()
+	if st.ended {
+		st.mu.Unlock()
+		return false
+	}
+	st.ended = true
+	sock := st.sock
+	st.queue, st.queued = nil, 0
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if sock != nil {
+		sock.Close()
+	}
+	s := st.s
+	s.mu.Lock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+	s.mu.Unlock()
+	logger.Noticef("[Mux] stream %d closed, %s, Session-Id:%s", st.id, time.Since(st.since), st.key)
+	return true
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 网关上的多路复用客户端
+type muxClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+// 以 rt 为唯一路由启动网关并连接
+func dialMux(t *testing.T, rt *RouteConf) *muxClient {
+	saved := cfg.Routes
+	t.Cleanup(func() { cfg.Routes = saved })
+	rt.Path, rt.Proto = "/mux", "mux"
+	if err := rt.compile(nil); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Routes = []*RouteConf{rt}
+
+	ws, _, err := websocket.DefaultDialer.Dial(testGateway(t)+"/mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return &muxClient{t: t, ws: ws}
+}
+
+func (c *muxClient) send(typ byte, id uint32, payload []byte) {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint32(b, id)
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, append(b, payload...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *muxClient) open(id uint32, token string) {
+	c.send(muxOpen, id, append([]byte{0}, token...))
+}
+
+// 读取下一个 typ 帧, 其间的 WINDOW 帧跳过
+func (c *muxClient) expect(typ byte, id uint32) []byte {
+	c.ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("waiting for frame %d on stream %d: %v", typ, id, err)
+		}
+		if msg[0] == muxWindow && typ != muxWindow {
+			continue
+		}
+		if msg[0] != typ || binary.BigEndian.Uint32(msg[1:]) != id {
+			c.t.Fatalf("frame %d on stream %d (%q), want %d on stream %d",
+				msg[0], binary.BigEndian.Uint32(msg[1:]), msg[muxHeaderLen:], typ, id)
+		}
+		return msg[muxHeaderLen:]
+	}
+}
+
+func (c *muxClient) expectReset(id uint32, reason string) {
+	b := c.expect(muxReset, id)
+	if code := int(binary.BigEndian.Uint16(b)); code != closeCodes[reason].Code {
+		c.t.Fatalf("stream %d reset with %d (%s), want %s", id, code, b[2:], reason)
+	}
+}
+
+// 每个连接交给 serve 处理的 TCP 后端
+func muxBackend(t *testing.T, serve func(c net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 收到 CONNECT 后不回复的 http 代理, 经由它的流一直处于连接中
+func holdingProxy(t *testing.T) *UpstreamConf {
+	hold := make(chan struct{})
+	addr := muxBackend(t, func(c net.Conn) {
+		http.ReadRequest(bufio.NewReader(c))
+		<-hold
+	})
+	t.Cleanup(func() { close(hold) })
+	return &UpstreamConf{URL: "http://" + addr}
+}
+
+func TestMuxEcho(t *testing.T) {
+	echo := muxBackend(t, func(c net.Conn) { io.Copy(c, c) })
+	c := dialMux(t, &RouteConf{})
+
+	c.open(1, echo)
+	c.expect(muxOpen, 1)
+	c.send(muxData, 1, []byte("hello"))
+	if b := c.expect(muxData, 1); string(b) != "hello" {
+		t.Fatalf("echo = %q", b)
+	}
+	c.send(muxClose, 1, nil)
+	c.expect(muxClose, 1)
+
+	//流结束后 ID 可以重用
+	time.Sleep(50 * time.Millisecond)
+	c.open(1, echo)
+	c.expect(muxOpen, 1)
+}
+
+func TestMuxWindowReturned(t *testing.T) {
+	sink := muxBackend(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	c := dialMux(t, &RouteConf{Mux: &MuxConf{Window: 16}})
+
+	c.open(1, sink)
+	c.expect(muxOpen, 1)
+	//每写入后端一次归还一次额度, 总共可以发送远超窗口的数据
+	for i := 0; i < 8; i++ {
+		c.send(muxData, 1, []byte("0123456789"))
+		if n := binary.BigEndian.Uint32(c.expect(muxWindow, 1)); n != 10 {
+			t.Fatalf("window += %d, want 10", n)
+		}
+	}
+}
+
+func TestMuxBackendRespectsWindow(t *testing.T) {
+	addr := muxBackend(t, func(c net.Conn) {
+		c.Write(make([]byte, 40))
+		io.Copy(io.Discard, c)
+	})
+	c := dialMux(t, &RouteConf{Mux: &MuxConf{Window: 16}})
+
+	c.open(1, addr)
+	c.expect(muxOpen, 1)
+	frames := make(chan []byte, 16)
+	go func() {
+		for {
+			_, msg, err := c.ws.ReadMessage()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- msg
+		}
+	}()
+	received := func(want int) {
+		n := 0
+		timeout := time.After(3 * time.Second)
+		for n < want {
+			select {
+			case msg := <-frames:
+				if msg[0] == muxData {
+					n += len(msg) - muxHeaderLen
+				}
+			case <-timeout:
+				t.Fatalf("%d of %d bytes received", n, want)
+			}
+		}
+		//窗口用完后不再发送
+		select {
+		case msg := <-frames:
+			t.Fatalf("frame %d with %d bytes sent past the window", msg[0], len(msg)-muxHeaderLen)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	c.ws.SetReadDeadline(time.Time{})
+	received(16)
+	c.send(muxWindow, 1, binary.BigEndian.AppendUint32(nil, 10))
+	received(10)
+	c.send(muxWindow, 1, binary.BigEndian.AppendUint32(nil, 100))
+	received(14)
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	got := make(chan string, 1)
+	addr := muxBackend(t, func(c net.Conn) {
+		b, _ := io.ReadAll(c)
+		got <- string(b)
+		//客户端半关闭之后仍然可以发送
+		c.Write([]byte("bye"))
+	})
+	c := dialMux(t, &RouteConf{})
+
+	c.open(1, addr)
+	c.expect(muxOpen, 1)
+	c.send(muxData, 1, []byte("ping"))
+	c.send(muxClose, 1, nil)
+	if s := <-got; s != "ping" {
+		t.Fatalf("backend read %q before EOF", s)
+	}
+	if b := c.expect(muxData, 1); string(b) != "bye" {
+		t.Fatalf("data after half-close = %q", b)
+	}
+	c.expect(muxClose, 1)
+}
+
+func TestMuxWindowViolation(t *testing.T) {
+	c := dialMux(t, &RouteConf{Upstream: holdingProxy(t), Mux: &MuxConf{Window: 16}})
+
+	//连接中的流不写入后端, 数据留在队列里占用窗口
+	c.open(1, "10.0.0.5:3306")
+	c.send(muxData, 1, []byte("0123456789"))
+	c.send(muxData, 1, []byte("0123456789"))
+	c.expectReset(1, closePolicy)
+}
+
+func TestMuxMaxStreams(t *testing.T) {
+	c := dialMux(t, &RouteConf{Upstream: holdingProxy(t), Mux: &MuxConf{MaxStreams: 2}})
+
+	c.open(1, "10.0.0.5:3306")
+	c.open(2, "10.0.0.5:3306")
+	c.open(3, "10.0.0.5:3306")
+	c.expectReset(3, closeOverload)
+
+	//客户端中止一个之后可以再打开
+	c.send(muxReset, 1, nil)
+	time.Sleep(50 * time.Millisecond)
+	c.open(3, "10.0.0.5:3306")
+	c.open(4, "10.0.0.5:3306")
+	c.expectReset(4, closeOverload)
+}
+
+func TestMuxClientReset(t *testing.T) {
+	eof := make(chan struct{})
+	addr := muxBackend(t, func(c net.Conn) {
+		io.Copy(io.Discard, c)
+		close(eof)
+	})
+	c := dialMux(t, &RouteConf{})
+
+	c.open(1, addr)
+	c.expect(muxOpen, 1)
+	c.send(muxReset, 1, nil)
+	select {
+	case <-eof:
+	case <-time.After(3 * time.Second):
+		t.Fatal("backend connection not closed after RESET")
+	}
+}
+
+func TestMuxBadToken(t *testing.T) {
+	c := dialMux(t, &RouteConf{Token: tokenAES})
+	c.open(1, "10.0.0.5:3306")
+	c.expectReset(1, closeBadToken)
+}
+
+func TestMuxProtocolViolation(t *testing.T) {
+	sink := muxBackend(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	for _, c := range []struct {
+		name  string
+		open  bool //先打开流 1, 未知类型只在流存在时检查
+		frame []byte
+	}{
+		{"stream id 0", false, []byte{muxData, 0, 0, 0, 0}},
+		{"short header", false, []byte{muxOpen, 0, 0}},
+		{"unknown type", true, []byte{9, 0, 0, 0, 1}},
+		{"short window", true, []byte{muxWindow, 0, 0, 0, 1, 0}},
+	} {
+		mc := dialMux(t, &RouteConf{})
+		if c.open {
+			mc.open(1, sink)
+			mc.expect(muxOpen, 1)
+		}
+		mc.ws.WriteMessage(websocket.BinaryMessage, c.frame)
+		mc.ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, _, err := mc.ws.ReadMessage()
+		if !websocket.IsCloseError(err, closeCodes[closePolicy].Code) {
+			t.Fatalf("%s: err = %v, want policy close", c.name, err)
+		}
+	}
+}
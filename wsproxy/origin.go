@@ -0,0 +1,179 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ************************************************************
+// 握手请求的 Origin 校验, 防止跨站 websocket 劫持
+//
+//	"origins": {
+//	  "*":  {"allow": ["https://app.example.com", "*.example.com"]},
+//	  "ws": {"allow": ["~^https://[a-z]+\\.corp\\.net$"], "require": true}
+//	}
+//
+// 键为路由名 (tcp/udp/ws), "*" 为未单独配置的路由使用的默认策略。
+// allow 中的写法:
+//
+//	https://app.example.com  完整匹配 scheme://host[:port]
+//	app.example.com          只匹配主机名
+//	*.example.com            子域名 (不含 example.com 本身), 可带 scheme
+//	~正则                    匹配完整的 Origin
+//	*                        任意 Origin
+//
+// 没有 Origin 头的请求 (非浏览器客户端) 默认放行, require 为 true 时拒绝。
+// 未配置 origins 时不做校验。拒绝时在升级之前返回 403, 握手时 CheckOrigin 按同一策略再次校验。
+// ************************************************************
+type OriginConf struct {
+	Allow   []string `json:"allow"`
+	Require bool     `json:"require"`
+
+	rules []originRule
+}
+
+type originRule struct {
+	any    bool
+	scheme string //为空时不比较
+	host   string //完整主机名, 或通配时的后缀 ".example.com"
+	suffix bool
+	re     *regexp.Regexp
+}
+
+func (oc *OriginConf) compile() error {
+	oc.rules = oc.rules[:0]
+	for _, a := range oc.Allow {
+		a = strings.TrimSpace(a)
+		var rule originRule
+		switch {
+		case a == "":
+			continue
+		case a == "*":
+			rule.any = true
+		case strings.HasPrefix(a, "~"):
+			re, err := regexp.Compile(a[1:])
+			if err != nil {
+				return fmt.Errorf("allow '%s': %s", a, err)
+			}
+			rule.re = re
+		default:
+			host := a
+			if i := strings.Index(a, "://"); i >= 0 {
+				rule.scheme, host = strings.ToLower(a[:i]), a[i+3:]
+			}
+			host = strings.ToLower(strings.TrimSuffix(host, "/"))
+			if strings.HasPrefix(host, "*.") {
+				rule.suffix, host = true, host[1:]
+			}
+			if host == "" || strings.ContainsAny(host, "*/") {
+				return fmt.Errorf("allow '%s': invalid origin", a)
+			}
+			rule.host = host
+		}
+		oc.rules = append(oc.rules, rule)
+	}
+	return nil
+}
+
+func (rule originRule) match(origin string, u *url.URL) bool {
+	switch {
+	case rule.any:
+		return true
+	case rule.re != nil:
+		return rule.re.MatchString(origin)
+	}
+	if rule.scheme != "" && rule.scheme != strings.ToLower(u.Scheme) {
+		return false
+	}
+
+	host := strings.ToLower(u.Host)
+	if rule.scheme == "" || rule.suffix {
+		// 未写 scheme 或通配时只比较主机名, 除非规则里写了端口
+		if !strings.Contains(rule.host, ":") {
+			host = strings.ToLower(u.Hostname())
+		}
+	}
+	if rule.suffix {
+		return strings.HasSuffix(host, rule.host)
+	}
+	return host == rule.host
+}
+
+func compileOrigins(m map[string]*OriginConf) (map[string]*OriginConf, error) {
+	origins := make(map[string]*OriginConf)
+	for name, oc := range m {
+		pt, ok := routeNames[name]
+		if name == "*" {
+			pt, ok = name, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown route '%s'", name)
+		}
+		if oc == nil {
+			continue
+		}
+		if err := oc.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		origins[pt] = oc
+	}
+	return origins, nil
+}
+
+type originKey struct{}
+
+// 记下路由的 Origin 策略, 供升级时的 CheckOrigin 使用
+func withOriginPolicy(r *http.Request, oc *OriginConf) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), originKey{}, oc))
+}
+
+// 升级时的 CheckOrigin, 请求中没有记下策略时不做校验
+func checkOrigin(r *http.Request) bool {
+	oc, _ := r.Context().Value(originKey{}).(*OriginConf)
+	_, ok := oc.check(r)
+	return ok
+}
+
+// 路由使用的 Origin 策略, 未配置时返回 nil
+func originPolicy(pt string) *OriginConf {
+	if oc, ok := cfg.origins[pt]; ok {
+		return oc
+	}
+	return cfg.origins["*"]
+}
+
+// 校验 Origin, 拒绝时返回原因 (用于日志)
+func (oc *OriginConf) check(r *http.Request) (string, bool) {
+	if oc == nil {
+		return "", true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if oc.Require {
+			return "missing Origin", false
+		}
+		return "", true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("malformed Origin '%s'", origin), false
+	}
+	for _, rule := range oc.rules {
+		if rule.match(origin, u) {
+			return "", true
+		}
+	}
+	return fmt.Sprintf("Origin '%s' not allowed", origin), false
+}
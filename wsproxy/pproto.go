@@ -0,0 +1,282 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"proxyproto"
+	"proxyproto/tlvparse"
+	"strings"
+)
+
+// tls.Config 版本号 -> PP2_SUBTYPE_SSL_VERSION 中的文本
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// ************************************************************
+// 构造 proxy-protocol 报文
+//
+//	v1 只支持 TCP, UDP 后端总是使用 v2
+//	源地址为客户端真实IP, 目的地址为实际连接的后端地址
+//	客户端与后端地址族不同时, IPv4 地址映射为 IPv6 (::ffff:a.b.c.d)
+//	v2 可附带 TLV: 会话ID、authority(SNI/Host)、TLS信息、自定义TLV
+//
+// ************************************************************
+func send_proxyproto(c net.Conn, r *http.Request, pt string, b *BackendConf, sid string) bool {
+	version := byte(b.ppVersion())
+	if pt == "udp" {
+		version = 2
+	}
+
+	src_ip, src_port := clientAddr(r)
+	var dst_ip net.IP
+	var dst_port int
+	switch a := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		dst_ip, dst_port = a.IP, a.Port
+	case *net.UDPAddr:
+		dst_ip, dst_port = a.IP, a.Port
+	}
+
+	_header := &proxyproto.Header{
+		Version: version,
+		Command: proxyproto.PROXY,
+	}
+	if src_ip == nil || dst_ip == nil {
+		// 无法得到地址时发送 LOCAL, 后端使用连接本身的地址
+		_header.Command = proxyproto.LOCAL
+		_header.TransportProtocol = proxyproto.UNSPEC
+	} else {
+		v4 := src_ip.To4() != nil && dst_ip.To4() != nil
+		if v4 {
+			src_ip, dst_ip = src_ip.To4(), dst_ip.To4()
+		} else {
+			src_ip, dst_ip = src_ip.To16(), dst_ip.To16()
+		}
+
+		if pt == "udp" {
+			_header.TransportProtocol = If(v4, proxyproto.UDPv4, proxyproto.UDPv6).(proxyproto.AddressFamilyAndProtocol)
+			_header.SourceAddr = &net.UDPAddr{IP: src_ip, Port: src_port}
+			_header.DestinationAddr = &net.UDPAddr{IP: dst_ip, Port: dst_port}
+		} else {
+			_header.TransportProtocol = If(v4, proxyproto.TCPv4, proxyproto.TCPv6).(proxyproto.AddressFamilyAndProtocol)
+			_header.SourceAddr = &net.TCPAddr{IP: src_ip, Port: src_port}
+			_header.DestinationAddr = &net.TCPAddr{IP: dst_ip, Port: dst_port}
+		}
+	}
+
+	if version == 2 && b.PPTLVs != nil {
+		if err := _header.SetTLVs(ppTLVs(r, b.PPTLVs, sid)); err != nil {
+			logger.Errorf("Error: %s, Session-Id:%s", err.Error(), sid)
+			return false
+		}
+	}
+
+	_, err := _header.WriteTo(c)
+	if err != nil {
+		logger.Errorf("Error: %s, Session-Id:%s", err.Error(), sid)
+		return false
+	}
+	return true
+}
+
+func ppTLVs(r *http.Request, t *PPTLVConf, sid string) []proxyproto.TLV {
+	var tlvs []proxyproto.TLV
+
+	if t.SessionID {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte(sid)})
+	}
+
+	if t.Authority {
+		authority := r.Host
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			authority = r.TLS.ServerName
+		} else if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			authority = h
+		}
+		if authority != "" {
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(authority)})
+		}
+	}
+
+	if t.SSL && r.TLS != nil {
+		if tlv, err := sslTLV(r.TLS).Marshal(); err == nil {
+			tlvs = append(tlvs, tlv)
+		}
+	}
+
+	for _, c := range t.custom {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2Type(c.typ), Value: c.value})
+	}
+	return tlvs
+}
+
+// 客户端 TLS 连接信息 -> PP2_TYPE_SSL
+func sslTLV(cs *tls.ConnectionState) tlvparse.PP2SSL {
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		Verify: 1,
+	}
+	if v, ok := tlsVersionNames[cs.Version]; ok {
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_VERSION, Value: []byte(v)})
+	}
+	ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_CIPHER, Value: []byte(tls.CipherSuiteName(cs.CipherSuite))})
+
+	if len(cs.PeerCertificates) > 0 {
+		ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN
+		if len(cs.VerifiedChains) > 0 {
+			ssl.Verify = 0
+		}
+		if cn := cs.PeerCertificates[0].Subject.CommonName; cn != "" {
+			ssl.TLV = append(ssl.TLV, proxyproto.TLV{Type: proxyproto.PP2_SUBTYPE_SSL_CN, Value: []byte(cn)})
+		}
+	}
+	return ssl
+}
+
+// ************************************************************
+// 网关自身监听端口接收 PROXY 协议头 (前面有 HAProxy/NLB 等L4负载均衡时)
+//
+//	"accept_proxy_protocol": {
+//	  "use":     ["10.0.0.0/8"],     //可以带PROXY头, 带了就使用其中的源地址
+//	  "require": ["192.168.0.0/16"], //必须带PROXY头
+//	  "skip":    ["127.0.0.1"],      //不解析, 作为普通连接
+//	  "default": "reject"            //其他来源: use/ignore/reject/require/skip
+//	}
+//
+// 解析出的源地址即为 r.RemoteAddr, 客户端IP、日志、限制以及发往后端的代理头都使用它
+// ************************************************************
+type AcceptPPConf struct {
+	Use     []string `json:"use"`
+	Require []string `json:"require"`
+	Skip    []string `json:"skip"`
+	Default string   `json:"default"`
+
+	policy proxyproto.PolicyFunc
+}
+
+var ppPolicyNames = map[string]proxyproto.Policy{
+	"use":     proxyproto.USE,
+	"ignore":  proxyproto.IGNORE,
+	"reject":  proxyproto.REJECT,
+	"require": proxyproto.REQUIRE,
+	"skip":    proxyproto.SKIP,
+}
+
+func (a *AcceptPPConf) compile() error {
+	// 默认拒绝非信任来源发送的PROXY头, 防止伪造源地址
+	def := proxyproto.REJECT
+	if a.Default != "" {
+		p, ok := ppPolicyNames[strings.ToLower(a.Default)]
+		if !ok {
+			return fmt.Errorf("accept_proxy_protocol: unknown default policy '%s'", a.Default)
+		}
+		def = p
+	}
+
+	skip, err := parseCIDRs(a.Skip)
+	if err != nil {
+		return fmt.Errorf("accept_proxy_protocol: %s", err)
+	}
+	require, err := parseCIDRs(a.Require)
+	if err != nil {
+		return fmt.Errorf("accept_proxy_protocol: %s", err)
+	}
+	use, err := parseCIDRs(a.Use)
+	if err != nil {
+		return fmt.Errorf("accept_proxy_protocol: %s", err)
+	}
+
+	a.policy = func(upstream net.Addr) (proxyproto.Policy, error) {
+		ip := addrIP(upstream)
+		switch {
+		case ip == nil:
+			return def, nil
+		case containsIP(skip, ip):
+			return proxyproto.SKIP, nil
+		case containsIP(require, ip):
+			return proxyproto.REQUIRE, nil
+		case containsIP(use, ip):
+			return proxyproto.USE, nil
+		}
+		return def, nil
+	}
+	return nil
+}
+
+// 监听端口使用的策略, 未配置时返回 nil (不解析PROXY头)
+func acceptPPPolicy() proxyproto.PolicyFunc {
+	if cfg.AcceptPP == nil {
+		return nil
+	}
+	return cfg.AcceptPP.policy
+}
+
+type ppConnKey struct{}
+
+// 把底层的 proxyproto.Conn 放进请求的 context, 便于读取其中的TLV
+func ppConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		return context.WithValue(ctx, ppConnKey{}, pc)
+	}
+	return ctx
+}
+
+// 负载均衡通过 PROXY v2 TLV 传来的云厂商信息
+type lbInfo struct {
+	awsVPCEndpoint string //AWS VPC endpoint ID
+	azureLinkID    uint32 //Azure private endpoint LINKID
+	gcpPSCID       uint64 //GCP Private Service Connect ID
+	hasAzure       bool
+	hasGCP         bool
+}
+
+func (m lbInfo) String() string {
+	var s []string
+	if m.awsVPCEndpoint != "" {
+		s = append(s, "aws_vpce="+m.awsVPCEndpoint)
+	}
+	if m.hasAzure {
+		s = append(s, fmt.Sprintf("azure_linkid=%d", m.azureLinkID))
+	}
+	if m.hasGCP {
+		s = append(s, fmt.Sprintf("gcp_psc=%d", m.gcpPSCID))
+	}
+	return strings.Join(s, ",")
+}
+
+func lbInfoFrom(r *http.Request) (m lbInfo) {
+	pc, ok := r.Context().Value(ppConnKey{}).(*proxyproto.Conn)
+	if !ok {
+		return
+	}
+	h := pc.ProxyHeader()
+	if h == nil || h.Version != 2 {
+		return
+	}
+	tlvs, err := h.TLVs()
+	if err != nil {
+		return
+	}
+
+	m.awsVPCEndpoint = tlvparse.FindAWSVPCEndpointID(tlvs)
+	m.azureLinkID, m.hasAzure = tlvparse.FindAzurePrivateEndpointLinkID(tlvs)
+	m.gcpPSCID, m.hasGCP = tlvparse.ExtractPSCConnectionID(tlvs)
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// 分片数, 会话的建立与释放只锁住其中一片
+const registryShards = 64
+
+// 会话登记表
+// 按会话ID哈希分片, 计数用原子操作, 取连接数为 O(1) 且不加锁
+type registry struct {
+	shards [registryShards]regShard
+	count  int64
+}
+
+type regShard struct {
+	sync.RWMutex
+	m map[string]*p_worker
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].m = make(map[string]*p_worker)
+	}
+	return r
+}
+
+func (r *registry) shard(key string) *regShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+// 占用一个连接名额, 超过 max 时返回 false
+// 拨号前先占位, 避免并发握手同时越过上限
+func (r *registry) reserve(max int) bool {
+	for {
+		n := atomic.LoadInt64(&r.count)
+		if n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.count, n, n+1) {
+			return true
+		}
+	}
+}
+
+// 归还未使用的名额
+func (r *registry) unreserve() {
+	atomic.AddInt64(&r.count, -1)
+}
+
+// 登记一个已占位的会话
+func (r *registry) add(p *p_worker) {
+	s := r.shard(p.key)
+	s.Lock()
+	s.m[p.key] = p
+	s.Unlock()
+}
+
+// 注销会话并归还名额
+// 同一个会话ID被后来的会话覆盖时只删除自己的登记项, 名额总是归还
+func (r *registry) remove(p *p_worker) {
+	s := r.shard(p.key)
+	s.Lock()
+	if s.m[p.key] == p {
+		delete(s.m, p.key)
+	}
+	s.Unlock()
+	atomic.AddInt64(&r.count, -1)
+}
+
+func (r *registry) get(key string) *p_worker {
+	s := r.shard(key)
+	s.RLock()
+	p := s.m[key]
+	s.RUnlock()
+	return p
+}
+
+// 当前连接数 (含已占位、正在拨号的会话)
+func (r *registry) Len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// 遍历所有会话, fn 返回 false 时停止
+// 每次只读锁一个分片并复制出快照, fn 在锁外执行, 不影响其他会话的建立与释放
+func (r *registry) Range(fn func(p *p_worker) bool) {
+	var snap []*p_worker
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.RLock()
+		snap = snap[:0]
+		for _, p := range s.m {
+			snap = append(snap, p)
+		}
+		s.RUnlock()
+
+		for _, p := range snap {
+			if !fn(p) {
+				return
+			}
+		}
+	}
+}
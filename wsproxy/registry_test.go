@@ -0,0 +1,237 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"gologger"
+	"gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 基准测试中登记表里已有的会话数
+const benchSessions = 50000
+
+func fillRegistry(tb testing.TB, n int) (*registry, []*p_worker) {
+	r := newRegistry()
+	ps := make([]*p_worker, n)
+	for i := range ps {
+		ps[i] = &p_worker{key: newSessionID()}
+		if !r.reserve(n) {
+			tb.Fatalf("reserve failed at %d", i)
+		}
+		r.add(ps[i])
+	}
+	return r, ps
+}
+
+func TestRegistryDuplicateKey(t *testing.T) {
+	r := newRegistry()
+	a, b := &p_worker{key: "same"}, &p_worker{key: "same"}
+	r.reserve(2)
+	r.add(a)
+	r.reserve(2)
+	r.add(b)
+	r.remove(b)
+	r.remove(a)
+	if n := r.Len(); n != 0 {
+		t.Fatalf("Len() = %d after removing both sessions, want 0", n)
+	}
+}
+
+// 一次握手的登记与释放: reserve + add + remove
+func BenchmarkRegistryHandshake(b *testing.B) {
+	r, _ := fillRegistry(b, benchSessions)
+	max := benchSessions + b.N + 1
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := &p_worker{key: newSessionID()}
+		r.reserve(max)
+		r.add(p)
+		r.remove(p)
+	}
+}
+
+func BenchmarkRegistryHandshakeParallel(b *testing.B) {
+	r, _ := fillRegistry(b, benchSessions)
+	max := benchSessions + b.N + 1
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p := &p_worker{key: newSessionID()}
+			r.reserve(max)
+			r.add(p)
+			r.remove(p)
+		}
+	})
+}
+
+func BenchmarkRegistryReserve(b *testing.B) {
+	r, _ := fillRegistry(b, benchSessions)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if r.reserve(benchSessions + 1) {
+				r.unreserve()
+			}
+		}
+	})
+}
+
+func BenchmarkRegistryGet(b *testing.B) {
+	r, ps := fillRegistry(b, benchSessions)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			r.get(ps[i%len(ps)].key)
+			i++
+		}
+	})
+}
+
+func BenchmarkRegistryRange(b *testing.B) {
+	r, _ := fillRegistry(b, benchSessions)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		r.Range(func(p *p_worker) bool {
+			n++
+			return true
+		})
+		if n != benchSessions {
+			b.Fatalf("Range visited %d sessions, want %d", n, benchSessions)
+		}
+	}
+}
+
+// 握手的同时有人在遍历 (例如 /sessions)
+func BenchmarkRegistryHandshakeDuringRange(b *testing.B) {
+	r, _ := fillRegistry(b, benchSessions)
+	max := benchSessions + b.N + 64
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			r.Range(func(p *p_worker) bool { return true })
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p := &p_worker{key: newSessionID()}
+			r.reserve(max)
+			r.add(p)
+			r.remove(p)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+}
+
+// 丢弃收到的数据的 TCP 后端
+func testBackend(tb testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 使用当前路由表的网关, 返回 ws:// 地址
+// 测试中不调用 parseFlags, 连接超时需要换算成纳秒
+func testGateway(tb testing.TB) string {
+	saved := cfgDialTimeout
+	cfgDialTimeout = uint(3 * time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveRoute(w, r, nil)
+	}))
+	tb.Cleanup(func() {
+		srv.Close()
+		cfgDialTimeout = saved
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// 只输出错误日志, 每次握手的请求日志会淹没基准测试的结果
+func quietLogger(tb testing.TB) {
+	console := &gologger.ConsoleConfig{Format: "%timestamp_format% [%level_string%] %body%"}
+	logger.Detach("console")
+	logger.Attach("console", gologger.LOGGER_LEVEL_ERROR, console)
+	tb.Cleanup(func() {
+		logger.Detach("console")
+		logger.Attach("console", gologger.LOGGER_LEVEL_DEBUG, console)
+	})
+}
+
+// 完整的握手: websocket 升级 + token 解析 + 连接 TCP 后端, 登记表里已有 50k 会话
+func BenchmarkHandshake(b *testing.B) {
+	benchmarkHandshake(b, false)
+}
+
+func BenchmarkHandshakeParallel(b *testing.B) {
+	benchmarkHandshake(b, true)
+}
+
+func benchmarkHandshake(b *testing.B, parallel bool) {
+	quietLogger(b)
+	saved, savedMax := sessions, max_connections
+	defer func() { sessions, max_connections = saved, savedMax }()
+	sessions, _ = fillRegistry(b, benchSessions)
+	//关闭的会话异步注销, 留出余量
+	setMaxConns(benchSessions + 10000)
+
+	u := testGateway(b) + "/?" + url.Values{cfgFormKey: {testBackend(b)}}.Encode()
+	shake := func() {
+		c, _, err := websocket.DefaultDialer.Dial(u, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c.Close()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			shake()
+		}
+		return
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			shake()
+		}
+	})
+}
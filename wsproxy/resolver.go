@@ -0,0 +1,534 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ************************************************************
+// 后端域名解析
+//
+//	"resolver": {
+//	  "servers": ["10.0.0.2:53", "10.0.0.3"], //DNS 服务器, 未配置时使用系统解析器
+//	  "hosts_file": "/etc/wsproxy/hosts",      //优先于 DNS, 格式同 /etc/hosts, 修改后自动生效
+//	  "prefer": "ipv4",                        //auto (默认, IPv6 优先) / ipv4 / ipv6 / ipv4_only / ipv6_only
+//	  "min_ttl": 5, "max_ttl": 300,            //记录 TTL 的上下限 (秒)
+//	  "ttl": 30,                               //系统解析器没有 TTL, 使用此缓存时间
+//	  "negative_ttl": 5,                       //解析失败的缓存时间
+//	  "fallback_delay": 300,                   //首选地址族多少毫秒未连上时并行连接另一个地址族
+//	  "timeout": 2                             //每次查询的超时 (秒)
+//	}
+//
+// 配置后连接后端时先查缓存, 过期才重新解析; 同时有 IPv4/IPv6 地址时
+// 按 RFC 8305 (happy eyeballs) 并行连接, 先连上的为准。
+// 未配置时与原来一致, 每次拨号由 net.Dialer 解析。
+// 后端组可以用 SRV 记录填充, 见 group.go
+// ************************************************************
+type ResolverConf struct {
+	Servers       []string `json:"servers"`
+	HostsFile     string   `json:"hosts_file"`
+	Prefer        string   `json:"prefer"`
+	MinTTL        int      `json:"min_ttl"`
+	MaxTTL        int      `json:"max_ttl"`
+	TTL           int      `json:"ttl"`
+	NegativeTTL   int      `json:"negative_ttl"`
+	FallbackDelay int      `json:"fallback_delay"`
+	Timeout       int      `json:"timeout"`
+
+	servers []string
+	hosts   *hostsFile
+
+	mu    sync.Mutex
+	cache map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	ready  chan struct{} //解析完成后关闭, 同一名称并发的查询只发一次
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// 未配置 resolver 时 SRV 组使用系统解析器
+var defaultResolver = &ResolverConf{}
+
+// 缓存的名称超过此数量时清理过期项
+const dnsCacheSize = 4096
+
+func init() {
+	defaultResolver.compile()
+}
+
+var preferNames = map[string]bool{"": true, "auto": true, "ipv4": true, "ipv6": true, "ipv4_only": true, "ipv6_only": true}
+
+func (rc *ResolverConf) compile() error {
+	if !preferNames[rc.Prefer] {
+		return fmt.Errorf("unknown prefer '%s'", rc.Prefer)
+	}
+	if rc.MinTTL < 0 || rc.MaxTTL < 0 || rc.TTL < 0 || rc.NegativeTTL < 0 || rc.FallbackDelay < 0 || rc.Timeout < 0 {
+		return fmt.Errorf("ttl/delay/timeout must not be negative")
+	}
+	if rc.MaxTTL == 0 {
+		rc.MaxTTL = 3600
+	}
+	if rc.MinTTL > rc.MaxTTL {
+		return fmt.Errorf("min_ttl greater than max_ttl")
+	}
+	if rc.TTL == 0 {
+		rc.TTL = 30
+	}
+	if rc.NegativeTTL == 0 {
+		rc.NegativeTTL = 5
+	}
+	if rc.FallbackDelay == 0 {
+		rc.FallbackDelay = 300
+	}
+	if rc.Timeout == 0 {
+		rc.Timeout = 2
+	}
+
+	rc.servers = nil
+	for _, s := range rc.Servers {
+		s = strings.TrimSpace(s)
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		if host, _, _ := net.SplitHostPort(s); net.ParseIP(host) == nil {
+			return fmt.Errorf("server '%s' must be an IP address", s)
+		}
+		rc.servers = append(rc.servers, s)
+	}
+
+	if rc.HostsFile != "" {
+		h := &hostsFile{path: rc.HostsFile}
+		if err := h.reload(); err != nil {
+			return fmt.Errorf("hosts_file: %s", err)
+		}
+		rc.hosts = h
+	}
+	rc.cache = make(map[string]*dnsEntry)
+	return nil
+}
+
+func (rc *ResolverConf) clampTTL(ttl uint32) time.Duration {
+	t := int(ttl)
+	if t < rc.MinTTL {
+		t = rc.MinTTL
+	}
+	if t > rc.MaxTTL {
+		t = rc.MaxTTL
+	}
+	return time.Duration(t) * time.Second
+}
+
+// 解析主机名, hosts 文件 > 缓存 > DNS
+func (rc *ResolverConf) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if rc.hosts != nil {
+		if ips := rc.hosts.lookup(name); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+
+	rc.mu.Lock()
+	e, ok := rc.cache[name]
+	if ok {
+		select {
+		case <-e.ready:
+			if time.Now().After(e.expire) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		if len(rc.cache) >= dnsCacheSize {
+			rc.prune()
+		}
+		e = &dnsEntry{ready: make(chan struct{})}
+		rc.cache[name] = e
+		rc.mu.Unlock()
+
+		var ttl time.Duration
+		e.ips, ttl, e.err = rc.resolve(name)
+		if e.err != nil {
+			ttl = time.Duration(rc.NegativeTTL) * time.Second
+		}
+		e.expire = time.Now().Add(ttl)
+		close(e.ready)
+	} else {
+		rc.mu.Unlock()
+	}
+
+	select {
+	case <-e.ready:
+		return e.ips, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 调用时持有 rc.mu
+func (rc *ResolverConf) prune() {
+	now := time.Now()
+	for name, e := range rc.cache {
+		select {
+		case <-e.ready:
+			if now.After(e.expire) {
+				delete(rc.cache, name)
+			}
+		default:
+		}
+	}
+}
+
+// 不受单个拨号的 context 影响, 结果供其他连接共用
+func (rc *ResolverConf) resolve(name string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rc.Timeout)*time.Second*time.Duration(len(rc.servers)+1))
+	defer cancel()
+
+	if len(rc.servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			ips[i] = a.IP
+		}
+		return ips, time.Duration(rc.TTL) * time.Second, nil
+	}
+
+	var qtypes []uint16
+	if rc.Prefer != "ipv6_only" {
+		qtypes = append(qtypes, dnsTypeA)
+	}
+	if rc.Prefer != "ipv4_only" {
+		qtypes = append(qtypes, dnsTypeAAAA)
+	}
+
+	type answer struct {
+		rrs []dnsRR
+		err error
+	}
+	answers := make(chan answer, len(qtypes))
+	for _, qt := range qtypes {
+		go func(qt uint16) {
+			rrs, err := dnsLookup(ctx, rc.servers, time.Duration(rc.Timeout)*time.Second, name, qt)
+			answers <- answer{rrs, err}
+		}(qt)
+	}
+
+	var ips []net.IP
+	var firstErr error
+	minTTL := uint32(1<<32 - 1)
+	for range qtypes {
+		a := <-answers
+		if a.err != nil {
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			continue
+		}
+		for _, rr := range a.rrs {
+			if rr.ip != nil {
+				ips = append(ips, rr.ip)
+				if rr.ttl < minTTL {
+					minTTL = rr.ttl
+				}
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return nil, 0, firstErr
+	}
+	return ips, rc.clampTTL(minTTL), nil
+}
+
+// SRV 记录, 返回优先级最高 (priority 最小) 的 target:port 与缓存时间
+func (rc *ResolverConf) lookupSRV(name string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rc.Timeout)*time.Second*time.Duration(len(rc.servers)+1))
+	defer cancel()
+
+	var srvs []*net.SRV
+	ttl := time.Duration(rc.TTL) * time.Second
+	if len(rc.servers) == 0 {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		srvs = records
+	} else {
+		rrs, err := dnsLookup(ctx, rc.servers, time.Duration(rc.Timeout)*time.Second, name, dnsTypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+		minTTL := uint32(1<<32 - 1)
+		for _, rr := range rrs {
+			if rr.srv != nil {
+				srvs = append(srvs, rr.srv)
+				if rr.ttl < minTTL {
+					minTTL = rr.ttl
+				}
+			}
+		}
+		ttl = rc.clampTTL(minTTL)
+	}
+	if len(srvs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no SRV records", Name: name, IsNotFound: true}
+	}
+
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	var addrs []string
+	for _, s := range srvs {
+		if s.Priority != srvs[0].Priority {
+			break
+		}
+		target := strings.TrimSuffix(s.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, fmt.Sprint(s.Port)))
+	}
+	return addrs, ttl, nil
+}
+
+// 按 prefer 排列: 首选地址族与备用地址族; 有源地址时只保留同一地址族
+func (rc *ResolverConf) order(ips []net.IP, local net.Addr) (primary, fallback []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if src := addrIP(local); src != nil {
+		if src.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+
+	switch rc.Prefer {
+	case "ipv4":
+		primary, fallback = v4, v6
+	case "ipv4_only":
+		primary = v4
+	case "ipv6_only":
+		primary = v6
+	default:
+		primary, fallback = v6, v4
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+	return
+}
+
+// ************************************************************
+// 解析后连接, TCP 按 happy eyeballs 并行连接两个地址族
+// ************************************************************
+func (rc *ResolverConf) dialContext(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	//解析与连接共用 -timeout
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	ips, err := rc.lookupIP(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	primary, fallback := rc.order(ips, d.LocalAddr)
+	if len(primary) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address", Addr: host}}
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return d.DialContext(ctx, network, net.JoinHostPort(primary[0].String(), port))
+	}
+	if len(fallback) == 0 {
+		return dialSerial(ctx, d, network, primary, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, 2)
+	start := func(ips []net.IP) {
+		go func() {
+			c, err := dialSerial(ctx, d, network, ips, port)
+			results <- result{c, err}
+		}()
+	}
+
+	start(primary)
+	timer := time.NewTimer(time.Duration(rc.FallbackDelay) * time.Millisecond)
+	defer timer.Stop()
+
+	pending, started := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !started {
+				start(fallback)
+				pending, started = pending+1, true
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					//另一个地址族也可能同时连上
+					go func() {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}()
+				}
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !started {
+				start(fallback)
+				pending, started = pending+1, true
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// 依次尝试同一地址族中的地址
+func dialSerial(ctx context.Context, d *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		c, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// ************************************************************
+// hosts 文件, 每行 "IP 名称 [别名...]", # 之后为注释;
+// 每隔 hostsPoll 检查一次修改时间, 变化后重新读取
+// ************************************************************
+const hostsPoll = 5 * time.Second
+
+type hostsFile struct {
+	path string
+
+	sync.RWMutex
+	names   map[string][]net.IP
+	mtime   time.Time
+	checked time.Time
+}
+
+func (h *hostsFile) reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string][]net.IP)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			names[name] = append(names[name], ip)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.names, h.mtime, h.checked = names, fi.ModTime(), time.Now()
+	h.Unlock()
+	return nil
+}
+
+func (h *hostsFile) lookup(name string) []net.IP {
+	h.RLock()
+	stale := time.Since(h.checked) > hostsPoll
+	h.RUnlock()
+	if stale {
+		h.Lock()
+		h.checked = time.Now()
+		mtime := h.mtime
+		h.Unlock()
+		if fi, err := os.Stat(h.path); err == nil && !fi.ModTime().Equal(mtime) {
+			if err := h.reload(); err != nil {
+				logger.Warningf("hosts_file %s: %s", h.path, err)
+			} else {
+				logger.Infof("hosts_file %s reloaded", h.path)
+			}
+		}
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+	return h.names[name]
+}
+
+// 连接后端使用的解析器, 未配置时返回 nil
+func backendResolver() *ResolverConf {
+	return cfg.Resolver
+}
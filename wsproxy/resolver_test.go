@@ -0,0 +1,126 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 同一端口上的 IPv4 与 IPv6 监听, ipv6 为 false 时 IPv6 端口不监听 (连接被拒绝)
+func dualStackBackend(t *testing.T, ipv6 bool) string {
+	ln4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln4.Close() })
+	_, port, _ := net.SplitHostPort(ln4.Addr().String())
+	if ipv6 {
+		ln6, err := net.Listen("tcp6", "[::1]:"+port)
+		if err != nil {
+			t.Skipf("no IPv6 loopback: %s", err)
+		}
+		t.Cleanup(func() { ln6.Close() })
+	}
+	return port
+}
+
+// hosts 文件中 dual.test 同时有 IPv4 与 IPv6 地址
+func dualStackResolver(t *testing.T, rc *ResolverConf) *ResolverConf {
+	rc.HostsFile = filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(rc.HostsFile, []byte("::1 dual.test\n127.0.0.1 dual.test\n"), 0600)
+	if err := rc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+// 拨号前暂停, 模拟没有响应的地址族
+func slowFamily(network string, delay time.Duration) func(string, string, syscall.RawConn) error {
+	return func(n, _ string, _ syscall.RawConn) error {
+		if n == network {
+			time.Sleep(delay)
+		}
+		return nil
+	}
+}
+
+func TestHappyEyeballsFallbackOnRefused(t *testing.T) {
+	port := dualStackBackend(t, false)
+	rc := dualStackResolver(t, &ResolverConf{FallbackDelay: 2000})
+	start := time.Now()
+	c, err := rc.dialContext(context.Background(), &net.Dialer{}, "tcp", net.JoinHostPort("dual.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ip := addrIP(c.RemoteAddr()); ip.To4() == nil {
+		t.Fatalf("connected to %s, want IPv4 fallback", c.RemoteAddr())
+	}
+	//首选地址族被拒绝后立即连接另一个, 不等 fallback_delay
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("fallback took %v", d)
+	}
+}
+
+func TestHappyEyeballsRace(t *testing.T) {
+	for _, c := range []struct {
+		prefer string
+		slow   string
+		want4  bool
+	}{
+		{"auto", "tcp6", true},
+		{"ipv4", "tcp4", false},
+		{"auto", "", false},
+		{"ipv4", "", true},
+	} {
+		port := dualStackBackend(t, true)
+		rc := dualStackResolver(t, &ResolverConf{Prefer: c.prefer, FallbackDelay: 50})
+		d := &net.Dialer{Control: slowFamily(c.slow, 2*time.Second)}
+		start := time.Now()
+		conn, err := rc.dialContext(context.Background(), d, "tcp", net.JoinHostPort("dual.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got4 := addrIP(conn.RemoteAddr()).To4() != nil; got4 != c.want4 {
+			t.Errorf("prefer %s, slow %q: connected to %s", c.prefer, c.slow, conn.RemoteAddr())
+		}
+		if el := time.Since(start); el > time.Second {
+			t.Errorf("prefer %s, slow %q: dial took %v", c.prefer, c.slow, el)
+		}
+	}
+}
+
+func TestHappyEyeballsOnly(t *testing.T) {
+	port := dualStackBackend(t, true)
+	rc := dualStackResolver(t, &ResolverConf{Prefer: "ipv4_only"})
+	c, err := rc.dialContext(context.Background(), &net.Dialer{Control: slowFamily("tcp4", 200*time.Millisecond)}, "tcp", net.JoinHostPort("dual.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if addrIP(c.RemoteAddr()).To4() == nil {
+		t.Fatalf("ipv4_only connected to %s", c.RemoteAddr())
+	}
+}
+
+func TestHappyEyeballsAllFail(t *testing.T) {
+	ln, _ := net.Listen("tcp4", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	rc := dualStackResolver(t, &ResolverConf{FallbackDelay: 50})
+	if _, err := rc.dialContext(context.Background(), &net.Dialer{}, "tcp", net.JoinHostPort("dual.test", port)); err == nil {
+		t.Fatal("dial succeeded with both families refused")
+	}
+}
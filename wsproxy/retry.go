@@ -0,0 +1,306 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorilla/websocket"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ************************************************************
+// 连接后端失败时重试
+//
+//	"retry": {"attempts": 3, "backoff": 100, "max_backoff": 1000}
+//
+//	attempts:    总共尝试的次数, 默认 1 (不重试)
+//	backoff:     第一次重试前等待的毫秒数, 之后每次翻倍, 默认 100
+//	max_backoff: 等待时间上限 (毫秒), 默认 1000
+//
+// 实际等待时间在 [d/2, d) 之间随机, 避免大量客户端同时重试;
+// 所有尝试都在 -timeout 之内完成, 剩余时间不够等待时不再重试。
+// 顶层 retry 为所有路由的默认值, 路由中的 retry 覆盖它。
+// websocket 后端拒绝握手 (返回非 101) 时不重试。
+// ************************************************************
+type RetryConf struct {
+	Attempts   int `json:"attempts"`
+	Backoff    int `json:"backoff"`
+	MaxBackoff int `json:"max_backoff"`
+}
+
+var defaultRetry = &RetryConf{Attempts: 1}
+
+func (rc *RetryConf) compile() error {
+	if rc.Attempts < 0 || rc.Backoff < 0 || rc.MaxBackoff < 0 {
+		return fmt.Errorf("attempts/backoff/max_backoff must not be negative")
+	}
+	if rc.Attempts == 0 {
+		rc.Attempts = 1
+	}
+	if rc.Backoff == 0 {
+		rc.Backoff = 100
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = 1000
+	}
+	if rc.MaxBackoff < rc.Backoff {
+		return fmt.Errorf("max_backoff less than backoff")
+	}
+	return nil
+}
+
+// 第 n 次重试前的等待时间
+func (rc *RetryConf) wait(n int) time.Duration {
+	d := time.Duration(rc.Backoff) * time.Millisecond << (n - 1)
+	if max := time.Duration(rc.MaxBackoff) * time.Millisecond; d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// 路由使用的重试设置, 未配置时使用顶层设置
+func (rt *RouteConf) retry() *RetryConf {
+	if rt.Retry != nil {
+		return rt.Retry
+	}
+	if cfg.Retry != nil {
+		return cfg.Retry
+	}
+	return defaultRetry
+}
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// 连接后端 (含重试) 的期限, 从收到握手请求开始计算 -timeout
+func dialBudget(since time.Time) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(context.Background(), since.Add(time.Duration(cfgDialTimeout)))
+}
+
+// 日志中的状态码
+func dialErrorCode(err error) int {
+	if errors.Is(err, errCircuitOpen) {
+		return codeCircuitOpen
+	}
+	return codeDialErr
+}
+
+// 后端有应答的错误不重试, 也不算作熔断失败
+func retryable(err error) bool {
+	return !errors.Is(err, websocket.ErrBadHandshake)
+}
+
+// 在 ctx 的期限内按退避重试 dial, 每次的结果记入 raddr 的熔断器
+func (rc *RetryConf) run(ctx context.Context, raddr string, dial func(context.Context) error) error {
+	b := breakers.get(raddr)
+	var err error
+	for n := 0; n < rc.Attempts; n++ {
+		if n > 0 {
+			w := rc.wait(n)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < w {
+				break
+			}
+			atomic.AddInt64(&metrics.dialRetries, 1)
+			t := time.NewTimer(w)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			}
+		}
+
+		if !b.allow() {
+			atomic.AddInt64(&metrics.breakerRejected, 1)
+			if err == nil {
+				err = errCircuitOpen
+			}
+			break
+		}
+		err = dial(ctx)
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			//调用方已放弃 (多路复用的连接断开), 不计入熔断
+			b.abandon()
+			return err
+		}
+		ok := err == nil || !retryable(err)
+		b.done(ok)
+		if ok {
+			return err
+		}
+	}
+	return err
+}
+
+// ************************************************************
+// 按后端地址的熔断器
+//
+//	"breaker": {"failures": 5, "cooldown": 30}
+//
+//	failures: 连续失败多少次后断开 (open), 0 为不启用 (默认)
+//	cooldown: 断开多少秒后进入半开 (half_open), 默认 30
+//
+// 断开期间直接以 circuit_open close code 拒绝, 不再连接后端;
+// 半开时只放行一个连接试探, 成功则恢复 (closed), 失败则重新断开。
+// 状态在 /status 与 /metrics 中输出。
+// ************************************************************
+type BreakerConf struct {
+	Failures int `json:"failures"`
+	Cooldown int `json:"cooldown"`
+}
+
+func (bc *BreakerConf) compile() error {
+	if bc.Failures < 0 || bc.Cooldown < 0 {
+		return fmt.Errorf("failures/cooldown must not be negative")
+	}
+	if bc.Cooldown == 0 {
+		bc.Cooldown = 30
+	}
+	return nil
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half_open"}
+
+type breaker struct {
+	addr string
+	conf *BreakerConf
+
+	sync.Mutex
+	state    int
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// 没有失败记录的熔断器超过此数量时清理
+const breakerTableSize = 4096
+
+type breakerTable struct {
+	sync.Mutex
+	m map[string]*breaker
+}
+
+var breakers = &breakerTable{m: make(map[string]*breaker)}
+
+// 未启用时返回 nil
+func (t *breakerTable) get(addr string) *breaker {
+	bc := cfg.Breaker
+	if bc == nil || bc.Failures == 0 {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	b, ok := t.m[addr]
+	if !ok {
+		if len(t.m) >= breakerTableSize {
+			for k, v := range t.m {
+				v.Lock()
+				if v.state == breakerClosed && v.failures == 0 {
+					delete(t.m, k)
+				}
+				v.Unlock()
+			}
+		}
+		b = &breaker{addr: addr, conf: bc}
+		t.m[addr] = b
+	}
+	return b
+}
+
+// 是否可以连接后端
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.opened) < time.Duration(b.conf.Cooldown)*time.Second {
+			return false
+		}
+		b.state = breakerHalfOpen
+		logger.Warningf("Circuit breaker half_open: %s", b.addr)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *breaker) done(ok bool) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if ok {
+		if b.state != breakerClosed {
+			logger.Warningf("Circuit breaker closed: %s", b.addr)
+		}
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	//已经断开时, 断开前发出的连接迟到的失败不延长冷却时间
+	if b.state == breakerOpen {
+		return
+	}
+	if b.state == breakerHalfOpen || b.failures >= b.conf.Failures {
+		logger.Warningf("Circuit breaker open: %s, %d consecutive failures", b.addr, b.failures)
+		b.state, b.opened = breakerOpen, time.Now()
+	}
+}
+
+// 连接被取消, 不计成败, 只让出半开状态的探测
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.probing = false
+	b.Unlock()
+}
+
+type breakerStatus struct {
+	addr     string
+	state    string
+	code     int
+	failures int
+}
+
+// 有失败记录或未恢复的熔断器, 按地址排序
+func (t *breakerTable) status() []breakerStatus {
+	t.Lock()
+	defer t.Unlock()
+	var s []breakerStatus
+	for _, b := range t.m {
+		b.Lock()
+		if b.state != breakerClosed || b.failures > 0 {
+			s = append(s, breakerStatus{b.addr, breakerStates[b.state], b.state, b.failures})
+		}
+		b.Unlock()
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].addr < s[j].addr })
+	return s
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerLateFailureKeepsCooldown(t *testing.T) {
+	b := &breaker{addr: "10.0.0.1:9000", conf: &BreakerConf{Failures: 2, Cooldown: 30}}
+	b.done(false)
+	b.done(false)
+	if b.state != breakerOpen {
+		t.Fatalf("state = %s after 2 failures, want open", breakerStates[b.state])
+	}
+	opened := b.opened.Add(-time.Minute)
+	b.opened = opened
+
+	//断开之前发出的连接迟到的失败
+	b.done(false)
+	if !b.opened.Equal(opened) {
+		t.Fatalf("late failure moved opened from %v to %v", opened, b.opened)
+	}
+	if !b.allow() || b.state != breakerHalfOpen {
+		t.Fatalf("cooldown over but state = %s", breakerStates[b.state])
+	}
+
+	//探测失败重新断开
+	b.done(false)
+	if b.state != breakerOpen || time.Since(b.opened) > time.Second {
+		t.Fatalf("failed probe: state = %s, opened %v ago", breakerStates[b.state], time.Since(b.opened))
+	}
+}
+
+func TestBreakerAddrsAdminOnly(t *testing.T) {
+	saved, savedTable := cfg.Breaker, breakers
+	defer func() { cfg.Breaker, breakers = saved, savedTable }()
+	cfg.Breaker = &BreakerConf{Failures: 1, Cooldown: 30}
+	breakers = &breakerTable{m: make(map[string]*breaker)}
+	breakers.get("10.0.0.9:9000").done(false)
+
+	body := func(routes func(*http.ServeMux)) string {
+		mux := http.NewServeMux()
+		routes(mux)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		return w.Body.String()
+	}
+	if b := body(adminRoutes); !strings.Contains(b, "10.0.0.9:9000 open") {
+		t.Fatalf("admin /status without the breaker:\n%s", b)
+	}
+	if b := body(publicRoutes); strings.Contains(b, "10.0.0.9") {
+		t.Fatalf("public /status exposes the backend address:\n%s", b)
+	}
+}
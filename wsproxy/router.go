@@ -0,0 +1,320 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"fmt"
+	"gorilla/websocket"
+	"net/http"
+	"strings"
+)
+
+// ************************************************************
+// 路由表, 按顺序匹配, 第一条命中的生效
+//
+//	"routes": [
+//	  {"path": "/", "proto": "tcp"},
+//	  {"path": "/game/{region}", "proto": "tcp", "group": "game-{region}", "token": "none"},
+//	  {"path": "/chat/*", "proto": "ws", "token": "aes",
+//	   "origin": {"allow": ["https://chat.example.com"]},
+//	   "compression": {"enable": true}, "subprotocols": ["mqtt"]}
+//	]
+//
+//	path:  精确路径; {name} 匹配一段路径并作为参数; 以 /* 结尾时匹配前缀
+//	proto: 后端协议 tcp/udp/ws, mux 为多路复用 (见 mux.go)
+//	group: 后端组 (见 groups), 可以引用路径参数
+//	token: auto (默认, 跟随 -aes_only) / aes (必须加密) / none (不需要 token, 从组内选择后端)
+//	origin/compression/subprotocols: 本路由的策略, 未配置时使用按协议的全局设置
+//	identities: 只有客户端证书身份匹配时才使用本路由 (见 identity.go), 否则继续匹配下一条;
+//	            group 中可以用 {client_cn} 引用证书 CN
+//	upstream: 本路由连接后端时经由的上游代理 (见 upstream.go)
+//	dial: 本路由连接后端时的源地址与 socket 选项 (见 sockopt.go)
+//	retry: 本路由连接后端失败时的重试 (见 retry.go)
+//	next_hop: 不直接连接后端, 经下一跳网关转发 (见 chain.go)
+//	mux: 多路复用路由的窗口与流数量 (见 mux.go)
+//
+// 未配置 routes 时与原来一致: / -> tcp, /udp -> udp, /ws -> ws
+// 路径不存在返回 404, 路径存在但证书身份不符返回 403, 不是 websocket 握手请求返回 400
+// ************************************************************
+type RouteConf struct {
+	Path         string        `json:"path"`
+	Proto        string        `json:"proto"`
+	Group        string        `json:"group"`
+	Token        string        `json:"token"`
+	Origin       *OriginConf   `json:"origin"`
+	Compression  *CompressConf `json:"compression"`
+	Subprotocols []string      `json:"subprotocols"`
+	Identities   []string      `json:"identities"`
+	Upstream     *UpstreamConf `json:"upstream"`
+	Dial         *DialConf     `json:"dial"`
+	Retry        *RetryConf    `json:"retry"`
+	NextHop      string        `json:"next_hop"`
+	Mux          *MuxConf      `json:"mux"`
+
+	pt       string   //tcp/udp/wss
+	nextAddr string   //next_hop 中的 host:port
+	segments []string //路径各段, {name} 为参数
+	prefix   bool
+}
+
+const (
+	tokenAuto = "auto"
+	tokenAES  = "aes"
+	tokenNone = "none"
+)
+
+var defaultRoutes = []*RouteConf{
+	{Path: "/", Proto: "tcp"},
+	{Path: "/udp", Proto: "udp"},
+	{Path: "/ws", Proto: "ws"},
+}
+
+func init() {
+	for _, rt := range defaultRoutes {
+		rt.compile(nil)
+	}
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+func (rt *RouteConf) compile(groups map[string]*GroupConf) error {
+	if !strings.HasPrefix(rt.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	pt, ok := routeNames[rt.Proto]
+	if !ok {
+		return fmt.Errorf("unknown proto '%s'", rt.Proto)
+	}
+	rt.pt = pt
+
+	path := rt.Path
+	if strings.HasSuffix(path, "/*") {
+		rt.prefix, path = true, strings.TrimSuffix(path, "*")
+	}
+	rt.segments = splitPath(path)
+	if rt.prefix {
+		rt.segments = rt.segments[:len(rt.segments)-1]
+	}
+	params := map[string]bool{}
+	for _, seg := range rt.segments {
+		if name, ok := pathParam(seg); ok {
+			if name == "" || params[name] {
+				return fmt.Errorf("invalid path parameter '%s'", seg)
+			}
+			params[name] = true
+		} else if strings.ContainsAny(seg, "{}*") {
+			return fmt.Errorf("invalid path segment '%s'", seg)
+		}
+	}
+
+	switch rt.Token {
+	case "":
+		rt.Token = tokenAuto
+	case tokenAuto, tokenAES:
+	case tokenNone:
+		if rt.Group == "" {
+			return fmt.Errorf("token 'none' requires a group")
+		}
+	default:
+		return fmt.Errorf("unknown token mode '%s'", rt.Token)
+	}
+
+	// 不含参数的组名在启动时检查
+	if rt.Group != "" && !strings.Contains(rt.Group, "{") {
+		if _, ok := groups[rt.Group]; !ok {
+			return fmt.Errorf("unknown group '%s'", rt.Group)
+		}
+	}
+
+	if rt.Origin != nil {
+		if err := rt.Origin.compile(); err != nil {
+			return fmt.Errorf("origin: %s", err)
+		}
+	}
+	if rt.Compression != nil {
+		if err := rt.Compression.compile(); err != nil {
+			return fmt.Errorf("compression: %s", err)
+		}
+	}
+	if rt.Upstream != nil {
+		if err := rt.Upstream.compile(); err != nil {
+			return fmt.Errorf("upstream: %s", err)
+		}
+		if rt.pt == "udp" && rt.Upstream.url != nil && rt.Upstream.url.Scheme == "http" {
+			return fmt.Errorf("upstream: http proxy cannot carry udp, use socks5")
+		}
+	}
+	if rt.Dial != nil {
+		if err := rt.Dial.compile(); err != nil {
+			return fmt.Errorf("dial: %s", err)
+		}
+	}
+	if rt.Retry != nil {
+		if err := rt.Retry.compile(); err != nil {
+			return fmt.Errorf("retry: %s", err)
+		}
+	}
+	if rt.Mux != nil {
+		if rt.pt != "mux" {
+			return fmt.Errorf("mux settings on a %s route", rt.Proto)
+		}
+		if err := rt.Mux.compile(); err != nil {
+			return fmt.Errorf("mux: %s", err)
+		}
+	}
+	if rt.NextHop != "" {
+		if rt.pt == "mux" {
+			return fmt.Errorf("next_hop is not supported on mux routes")
+		}
+		var ok bool
+		if rt.nextAddr, ok = urlAddr(rt.NextHop); !ok {
+			return fmt.Errorf("next_hop must be ws:// or wss://")
+		}
+	}
+	return nil
+}
+
+func pathParam(seg string) (string, bool) {
+	if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+		return seg[1 : len(seg)-1], true
+	}
+	return "", false
+}
+
+// 匹配请求路径, 返回路径参数
+func (rt *RouteConf) match(segs []string) (map[string]string, bool) {
+	if len(segs) < len(rt.segments) || !rt.prefix && len(segs) != len(rt.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range rt.segments {
+		if name, ok := pathParam(seg); ok {
+			if segs[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[name] = segs[i]
+		} else if seg != segs[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func routeTable() []*RouteConf {
+	if len(cfg.Routes) > 0 {
+		return cfg.Routes
+	}
+	return defaultRoutes
+}
+
+// 路径匹配但证书身份不符的路由被跳过, 没有其他路由命中时 denied 为 true
+func matchRoute(routes []*RouteConf, path string, id *clientIdentity) (rt *RouteConf, params map[string]string, denied bool) {
+	segs := splitPath(path)
+	for _, rt := range routes {
+		params, ok := rt.match(segs)
+		if !ok {
+			continue
+		}
+		if len(rt.Identities) > 0 && !id.matches(rt.Identities) {
+			denied = true
+			continue
+		}
+		if id != nil {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params["client_cn"] = id.cn
+		}
+		return rt, params, false
+	}
+	return nil, nil, denied
+}
+
+// 路由使用的后端组, 未配置时返回 nil
+func (rt *RouteConf) group(params map[string]string) (*GroupConf, bool) {
+	if rt.Group == "" {
+		return nil, true
+	}
+	name := rt.Group
+	for k, v := range params {
+		name = strings.Replace(name, "{"+k+"}", v, -1)
+	}
+	g, ok := cfg.Groups[name]
+	return g, ok
+}
+
+func (rt *RouteConf) aesOnly() bool {
+	return rt.Token == tokenAES || aesOnly
+}
+
+func (rt *RouteConf) originPolicy() *OriginConf {
+	if rt.Origin != nil {
+		return rt.Origin
+	}
+	return originPolicy(rt.pt)
+}
+
+func (rt *RouteConf) compression() *CompressConf {
+	if rt.Compression != nil {
+		return rt.Compression
+	}
+	return cfg.compress[rt.pt]
+}
+
+func (rt *RouteConf) subprotocols() []string {
+	if rt.Subprotocols != nil {
+		return rt.Subprotocols
+	}
+	return staticSubprotocols
+}
+
+// 一次请求匹配到的路由
+type routeMatch struct {
+	route *RouteConf
+	group *GroupConf //路由未配置后端组时为 nil
+	vhost *VHostConf //未命中虚拟主机时为 nil
+}
+
+// 所有 websocket 请求的入口, allowed 为监听地址开放的路由 (nil 为全部)
+func serveRoute(w http.ResponseWriter, r *http.Request, allowed map[string]bool) {
+	vh, ok := vhostFor(r)
+	if !ok {
+		http.Error(w, "421 Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	id := peerIdentity(r)
+	rt, params, denied := matchRoute(vh.routeTable(), r.URL.Path, id)
+	if denied {
+		subject := "none"
+		if id != nil {
+			subject = id.subject
+		}
+		logger.Warningf("Client certificate rejected: %s, %s %s", subject, clientIPString(r), r.URL.Path)
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	if rt == nil || allowed != nil && !allowed[rt.Path] {
+		http.NotFound(w, r)
+		return
+	}
+	g, ok := rt.group(params)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "400 Bad Request: websocket handshake expected", http.StatusBadRequest)
+		return
+	}
+	handles(w, r, &routeMatch{route: rt, group: g, vhost: vh})
+}
@@ -10,27 +10,61 @@ package main
 import (
     "fmt"
 	"net/http"
+    "strings"
+    "sync/atomic"
+    "time"
 )
 
-func init() {
+// 网关自身的管理路径, 只在管理端口提供
+// 会话列表中有客户端与后端地址, 不能对外
+func adminRoutes(mux *http.ServeMux) {
     //run http normal
-    http.HandleFunc("/status", url_status)
-    http.HandleFunc("/ok", url_check)
+    mux.HandleFunc("/status", url_status)
+    mux.HandleFunc("/ok", url_check)
+    mux.HandleFunc("/sessions", url_sessions)
+    mux.HandleFunc("/metrics", url_metrics)
     //...
 }
 
+// 所有监听地址上的路径, 负载均衡与容器的健康检查使用
+func publicRoutes(mux *http.ServeMux) {
+    mux.HandleFunc("/status", url_public_status)
+    mux.HandleFunc("/ok", url_check)
+}
+
 
 //monitor
 func url_status(w http.ResponseWriter, r *http.Request) {
+    status(w, r, true)
+}
+
+//公开监听地址上只有汇总信息, 后端ip地址不直接对外
+func url_public_status(w http.ResponseWriter, r *http.Request) {
+    status(w, r, false)
+}
+
+func status(w http.ResponseWriter, r *http.Request, detail bool) {
     logger.Info(r.URL.String())
     w.Header().Set("Server", fmt.Sprintf("WSproxy v%s\n", __VERSION__))
 	//html := "====== Hello WSproxy! ======\n" + fmt.Sprintf("Conns available: %v\n", len(pool))
     html := fmt.Sprintf(`====== Hello WSproxy! ======
     UUID: %s
     Conns available: %v
+    Compression ratio: %.3f
+    Dial retries: %d
+    Circuit breakers: %d
     `, 
       serverUUID,
-      len(pool))
+      sessions.Len(),
+      compressRatio(),
+      atomic.LoadInt64(&metrics.dialRetries),
+      len(breakers.status()))
+    //熔断器: 后端地址 状态 连续失败次数
+    if detail {
+        for _, b := range breakers.status() {
+            html += fmt.Sprintf("      %s %s %d\n", b.addr, b.state, b.failures)
+        }
+    }
     
 	_, err := w.Write([]byte(html))
 	if err != nil {
@@ -49,3 +83,49 @@ func url_check(w http.ResponseWriter, r *http.Request) {
 		logger.Errorf("Html write err: %s", err)
 	}
 }
+
+//metrics
+//Prometheus 文本格式
+func url_metrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Server", fmt.Sprintf("WSproxy v%s\n", __VERSION__))
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+    var b strings.Builder
+    fmt.Fprintf(&b, "wsproxy_sessions %d\n", sessions.Len())
+    fmt.Fprintf(&b, "wsproxy_compress_payload_bytes_total %d\n", atomic.LoadInt64(&metrics.compressPayload))
+    fmt.Fprintf(&b, "wsproxy_compress_wire_bytes_total %d\n", atomic.LoadInt64(&metrics.compressWire))
+    fmt.Fprintf(&b, "wsproxy_compress_ratio %.4f\n", compressRatio())
+    fmt.Fprintf(&b, "wsproxy_dial_retries_total %d\n", atomic.LoadInt64(&metrics.dialRetries))
+    fmt.Fprintf(&b, "wsproxy_breaker_rejected_total %d\n", atomic.LoadInt64(&metrics.breakerRejected))
+    //0 closed, 1 open, 2 half_open
+    for _, s := range breakers.status() {
+        fmt.Fprintf(&b, "wsproxy_breaker_state{backend=%q,state=%q} %d\n", s.addr, s.state, s.code)
+        fmt.Fprintf(&b, "wsproxy_breaker_failures{backend=%q} %d\n", s.addr, s.failures)
+    }
+
+	_, err := w.Write([]byte(b.String()))
+	if err != nil {
+		logger.Errorf("Html write err: %s", err)
+	}
+}
+
+//sessions
+//每行一个会话: Session-Id 协议 客户端地址 后端地址 持续时间 负载均衡信息
+func url_sessions(w http.ResponseWriter, r *http.Request) {
+    logger.Info(r.URL.String())
+    w.Header().Set("Server", fmt.Sprintf("WSproxy v%s\n", __VERSION__))
+
+    var b strings.Builder
+    sessions.Range(func(p *p_worker) bool {
+        fmt.Fprintf(&b, "%s %s %s %s %v %s\n",
+            p.key, p.proto, p.remote, p.raddr,
+            time.Since(p.since).Truncate(time.Second),
+            If(p.lb.String()=="", "-", p.lb.String()).(string))
+        return true
+    })
+
+	_, err := w.Write([]byte(b.String()))
+	if err != nil {
+		logger.Errorf("Html write err: %s", err)
+	}
+}
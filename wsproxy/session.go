@@ -0,0 +1,35 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/google/uuid"
+	"time"
+)
+
+// 返回给客户端以及传递给后端的会话ID头部
+const sessionHeader = "X-Session-Id"
+
+// 生成会话ID (UUIDv7, RFC 9562)
+// 前48位为毫秒时间戳, 其余74位随机, 按时间有序且不会像 crc32 那样碰撞
+func newSessionID() string {
+	var u uuid.UUID
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixMilli()))
+	copy(u[:6], ts[2:])
+
+	if _, err := rand.Read(u[6:]); err != nil {
+		// 随机源不可用时退回 v4
+		return uuid.New().String()
+	}
+	u[6] = (u[6] & 0x0f) | 0x70 // version 7
+	u[8] = (u[8] & 0x3f) | 0x80 // variant RFC 4122
+	return u.String()
+}
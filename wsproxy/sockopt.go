@@ -0,0 +1,126 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ************************************************************
+// 连接后端时的源地址与 socket 选项
+//
+//	"dial": {
+//	  "source": "10.0.0.5",          //源IP, 多网卡时后端按网关地址放行
+//	  "nodelay": true,               //TCP_NODELAY, 默认开启
+//	  "keepalive": 30,               //空闲多少秒后开始探测, 0 为默认 (15秒), -1 关闭
+//	  "keepalive_interval": 10,      //探测间隔 (秒), 仅 linux
+//	  "keepalive_count": 3,          //探测次数, 仅 linux
+//	  "sndbuf": 262144,              //SO_SNDBUF
+//	  "rcvbuf": 262144,              //SO_RCVBUF
+//	  "user_timeout": 30000,         //TCP_USER_TIMEOUT (毫秒), 仅 linux
+//	  "mark": 100                    //SO_MARK, 用于策略路由, 仅 linux, 需要 CAP_NET_ADMIN
+//	}
+//
+// 顶层 dial 为所有路由的默认值, 路由中的 dial 整体覆盖它;
+// 经上游代理时作用于到代理的连接。缓冲区、超时、mark 与 keepalive 参数在 connect 之前
+// 通过 net.Dialer 的 Control 设置 (见 sockopt_linux.go)
+// ************************************************************
+type DialConf struct {
+	Source            string `json:"source"`
+	NoDelay           *bool  `json:"nodelay"`
+	KeepAlive         int    `json:"keepalive"`
+	KeepAliveInterval int    `json:"keepalive_interval"`
+	KeepAliveCount    int    `json:"keepalive_count"`
+	SendBuffer        int    `json:"sndbuf"`
+	RecvBuffer        int    `json:"rcvbuf"`
+	UserTimeout       int    `json:"user_timeout"`
+	Mark              int    `json:"mark"`
+
+	source net.IP
+}
+
+var defaultDial = &DialConf{}
+
+func (dc *DialConf) compile() error {
+	if dc.Source != "" {
+		if dc.source = net.ParseIP(strings.Trim(dc.Source, "[]")); dc.source == nil {
+			return fmt.Errorf("invalid source address '%s'", dc.Source)
+		}
+	}
+	if dc.KeepAlive < -1 || dc.KeepAliveInterval < 0 || dc.KeepAliveCount < 0 {
+		return fmt.Errorf("keepalive values must not be negative")
+	}
+	if dc.KeepAlive < 0 && (dc.KeepAliveInterval > 0 || dc.KeepAliveCount > 0) {
+		return fmt.Errorf("keepalive_interval/keepalive_count require keepalive enabled")
+	}
+	if dc.SendBuffer < 0 || dc.RecvBuffer < 0 || dc.UserTimeout < 0 || dc.Mark < 0 {
+		return fmt.Errorf("sndbuf/rcvbuf/user_timeout/mark must not be negative")
+	}
+	return checkSockopts(dc)
+}
+
+// 按网络类型构造 net.Dialer, 源地址须与之匹配 (tcp/udp)
+func (dc *DialConf) netDialer(network string) *net.Dialer {
+	d := &net.Dialer{Timeout: time.Duration(cfgDialTimeout)}
+	if dc.source != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: dc.source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: dc.source}
+		}
+	}
+
+	switch {
+	case dc.KeepAlive < 0:
+		d.KeepAlive = -1
+	case dc.keepAliveControl():
+		//Go 在连接建立后会把探测间隔也设成 KeepAlive, 改为全部在 control 中设置
+		d.KeepAlive = -1
+	default:
+		d.KeepAlive = time.Duration(dc.KeepAlive) * time.Second
+	}
+
+	if dc.SendBuffer > 0 || dc.RecvBuffer > 0 || dc.UserTimeout > 0 || dc.Mark > 0 || dc.keepAliveControl() {
+		d.Control = dc.control
+	}
+	return d
+}
+
+func (dc *DialConf) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if rc := backendResolver(); rc != nil {
+		c, err = rc.dialContext(ctx, dc.netDialer(network), network, addr)
+	} else {
+		c, err = dc.netDialer(network).DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dc.afterDial(c)
+	//Go 在连接建立后才设置 TCP_NODELAY, 所以关闭时只能在此之后
+	if tc, ok := c.(*net.TCPConn); ok && dc.NoDelay != nil && !*dc.NoDelay {
+		tc.SetNoDelay(false)
+	}
+	return c, nil
+}
+
+// 路由使用的拨号设置, 未配置时使用顶层设置
+func (rt *RouteConf) dialConf() *DialConf {
+	if rt.Dial != nil {
+		return rt.Dial
+	}
+	if cfg.Dial != nil {
+		return cfg.Dial
+	}
+	return defaultDial
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// syscall 包中没有定义
+const tcpUserTimeout = 0x12
+
+func checkSockopts(dc *DialConf) error {
+	return nil
+}
+
+// 配置了 keepalive 参数时由 control 设置, 未配置的项使用 Go 的默认值 (15秒, 9次)
+// keepalive 为 -1 时关闭, 其他参数不生效
+func (dc *DialConf) keepAliveControl() bool {
+	if dc.KeepAlive < 0 {
+		return false
+	}
+	return dc.KeepAlive > 0 || dc.KeepAliveInterval > 0 || dc.KeepAliveCount > 0
+}
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// connect 之前设置 socket 选项
+func (dc *DialConf) control(network, address string, c syscall.RawConn) error {
+	var serr error
+	set := func(fd uintptr, name string, level, opt, value int) {
+		if serr == nil && value > 0 {
+			if err := syscall.SetsockoptInt(int(fd), level, opt, value); err != nil {
+				serr = fmt.Errorf("setsockopt %s: %w", name, err)
+			}
+		}
+	}
+
+	err := c.Control(func(fd uintptr) {
+		set(fd, "SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, dc.SendBuffer)
+		set(fd, "SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, dc.RecvBuffer)
+		set(fd, "SO_MARK", syscall.SOL_SOCKET, syscall.SO_MARK, dc.Mark)
+		if strings.HasPrefix(network, "tcp") {
+			set(fd, "TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, dc.UserTimeout)
+		}
+		if strings.HasPrefix(network, "tcp") && dc.keepAliveControl() {
+			set(fd, "SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+			set(fd, "TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, orDefault(dc.KeepAlive, 15))
+			set(fd, "TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, orDefault(dc.KeepAliveInterval, 15))
+			set(fd, "TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, orDefault(dc.KeepAliveCount, 9))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// 已在 control 中设置
+func (dc *DialConf) afterDial(c net.Conn) {}
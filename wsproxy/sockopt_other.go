@@ -0,0 +1,53 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// 其他平台只支持缓冲区大小与 keepalive 空闲时间
+func checkSockopts(dc *DialConf) error {
+	if dc.UserTimeout > 0 || dc.Mark > 0 {
+		return fmt.Errorf("user_timeout and mark are only supported on linux")
+	}
+	if dc.KeepAliveInterval > 0 || dc.KeepAliveCount > 0 {
+		return fmt.Errorf("keepalive_interval and keepalive_count are only supported on linux")
+	}
+	return nil
+}
+
+// keepalive 空闲时间由 net.Dialer 设置 (探测间隔与之相同)
+func (dc *DialConf) keepAliveControl() bool {
+	return false
+}
+
+// 各平台 socket 句柄类型不同, 缓冲区改为在连接建立后设置
+func (dc *DialConf) control(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func (dc *DialConf) afterDial(c net.Conn) {
+	b, ok := c.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	})
+	if !ok {
+		return
+	}
+	if dc.RecvBuffer > 0 {
+		b.SetReadBuffer(dc.RecvBuffer)
+	}
+	if dc.SendBuffer > 0 {
+		b.SetWriteBuffer(dc.SendBuffer)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDialKeepAliveOff(t *testing.T) {
+	dc := &DialConf{KeepAlive: -1, KeepAliveInterval: 10}
+	if err := dc.compile(); err == nil {
+		t.Fatal("keepalive -1 with keepalive_interval accepted")
+	}
+
+	dc = &DialConf{KeepAlive: -1}
+	if err := dc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	dc.KeepAliveCount = 3 //绕过 compile 也不能重新打开
+	if dc.keepAliveControl() {
+		t.Fatal("keepalive -1 still set in control")
+	}
+	if d := dc.netDialer("tcp"); d.KeepAlive >= 0 || d.Control != nil {
+		t.Fatalf("dialer KeepAlive = %v, control set = %v", d.KeepAlive, d.Control != nil)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"gorilla/websocket"
+	"net/http"
+)
+
+// ************************************************************
+// 子协议协商 (Sec-WebSocket-Protocol)
+//
+//	TCP/UDP 路由: 使用静态允许列表 (-subprotocols 或配置 subprotocols),
+//	             按列表顺序选出客户端也支持的第一个
+//	/ws 路由:    以客户端提供的子协议连接后端, 后端选中哪个就回给客户端哪个
+//
+// 客户端请求了子协议但没有选中时, MQTT/STOMP/graphql-ws 等客户端库通常会直接断开
+// ************************************************************
+
+var staticSubprotocols []string
+
+// 连接 websocket 后端时提供的子协议
+func offeredSubprotocols(r *http.Request) []string {
+	return websocket.Subprotocols(r)
+}
+
+// 回给客户端的子协议, 与后端选中的一致
+// 返回非 nil 的空列表, 后端没有选中时也不会从其他头部取值
+func backendSubprotocol(wc *websocket.Conn) []string {
+	if p := wc.Subprotocol(); p != "" {
+		return []string{p}
+	}
+	return []string{}
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ************************************************************
+// 监听地址的 TLS 设置
+//
+//	"tls": {
+//	  "cert": "cert.pem", "key": "key.pem",
+//	  "cert_dir": "/etc/wsproxy/certs", //按 SNI 选择的证书目录, 文件变化后自动加载
+//	  "dev": false,                     //没有 cert 时使用自签名证书, 只用于开发
+//	  "client_auth": "require",       //none/request/optional/require
+//	  "client_ca": "devices-ca.pem",  //校验客户端证书的CA
+//	  "crl": ["devices-ca.crl"],      //证书吊销列表, PEM 或 DER
+//	  "min_version": "1.2",           //1.0/1.1/1.2/1.3
+//	  "max_version": "1.3",
+//	  "curves": ["X25519", "P256"],
+//	  "ciphers": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],  //只作用于 TLS 1.2 及以下
+//	  "ticket_keys": ["ticket.key", "ticket.key.old"],       //第一个用于加密
+//	  "disable_tickets": false,
+//	  "ocsp_staple": "cert.ocsp",     //DER 格式的 OCSP 响应
+//	  "reload": 3600                  //重新读取 ticket_keys、ocsp_staple 与 crl 的间隔(秒)
+//	}
+//
+//	request:  要求客户端提供证书但不校验 (只用于记录)
+//	optional: 提供了证书时必须通过校验
+//	require:  必须提供并通过校验
+//
+// 通过校验的证书身份可用于路由 (routes 的 identities) 并转发给后端。
+// ALPN 固定为 http/1.1, websocket 握手不走 HTTP/2。所有设置在启动时校验。
+// ************************************************************
+type ListenerTLSConf struct {
+	Cert       string   `json:"cert"`
+	Key        string   `json:"key"` //为空时从 cert 文件中读取
+	CertDir    string   `json:"cert_dir"`
+	Dev        bool     `json:"dev"`
+	ClientAuth string   `json:"client_auth"`
+	ClientCA   string   `json:"client_ca"`
+	CRL        []string `json:"crl"`
+
+	MinVersion     string   `json:"min_version"`
+	MaxVersion     string   `json:"max_version"`
+	Curves         []string `json:"curves"`
+	Ciphers        []string `json:"ciphers"`
+	TicketKeys     []string `json:"ticket_keys"`
+	DisableTickets bool     `json:"disable_tickets"`
+	OCSPStaple     string   `json:"ocsp_staple"`
+	Reload         int      `json:"reload"`
+
+	config *tls.Config
+	cert   atomic.Pointer[tls.Certificate] //cert/key 以及 OCSP 响应
+	crls   atomic.Pointer[[]*x509.RevocationList]
+	dir    *certDir
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"none":     tls.NoClientCert,
+	"request":  tls.RequestClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+func (t *ListenerTLSConf) compile() error {
+	auth, ok := clientAuthTypes[t.ClientAuth]
+	if !ok {
+		return fmt.Errorf("unknown client_auth '%s'", t.ClientAuth)
+	}
+	c := &tls.Config{
+		GetCertificate:         t.getCertificate,
+		ClientAuth:             auth,
+		NextProtos:             []string{"http/1.1"},
+		SessionTicketsDisabled: t.DisableTickets,
+	}
+
+	if err := t.hardening(c); err != nil {
+		return err
+	}
+	if err := t.loadCert(); err != nil {
+		return err
+	}
+	if t.CertDir != "" {
+		d, err := newCertDir(t.CertDir)
+		if err != nil {
+			return fmt.Errorf("cert_dir: %s", err)
+		}
+		t.dir = d
+	}
+	if t.Dev && t.Cert == "" {
+		c, err := devCertificate()
+		if err != nil {
+			return fmt.Errorf("dev: %s", err)
+		}
+		t.cert.Store(c)
+	}
+	if len(t.TicketKeys) > 0 {
+		if t.DisableTickets {
+			return fmt.Errorf("ticket_keys conflicts with disable_tickets")
+		}
+		keys, err := readTicketKeys(t.TicketKeys)
+		if err != nil {
+			return fmt.Errorf("ticket_keys: %s", err)
+		}
+		c.SetSessionTicketKeys(keys)
+	}
+	if t.Reload < 0 {
+		return fmt.Errorf("invalid reload %d", t.Reload)
+	}
+
+	if auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert {
+		if t.ClientCA == "" {
+			return fmt.Errorf("client_auth '%s' requires client_ca", t.ClientAuth)
+		}
+	}
+	if t.ClientCA != "" {
+		pem, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return fmt.Errorf("client_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client_ca: no certificates in %s", t.ClientCA)
+		}
+		c.ClientCAs = pool
+
+		crls, err := loadCRLs(t.CRL, t.ClientCA)
+		if err != nil {
+			return fmt.Errorf("crl: %s", err)
+		}
+		if len(crls) > 0 {
+			t.crls.Store(&crls)
+			c.VerifyPeerCertificate = t.checkRevoked
+		}
+	} else if len(t.CRL) > 0 {
+		return fmt.Errorf("crl requires client_ca")
+	}
+
+	t.config = c
+	return nil
+}
+
+// 协议版本、曲线与加密套件
+func (t *ListenerTLSConf) hardening(c *tls.Config) error {
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown min_version '%s'", t.MinVersion)
+		}
+		c.MinVersion = v
+	}
+	if t.MaxVersion != "" {
+		v, ok := tlsVersions[t.MaxVersion]
+		if !ok {
+			return fmt.Errorf("unknown max_version '%s'", t.MaxVersion)
+		}
+		c.MaxVersion = v
+	}
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return fmt.Errorf("min_version %s is above max_version %s", t.MinVersion, t.MaxVersion)
+	}
+
+	for _, name := range t.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("unknown curve '%s'", name)
+		}
+		c.CurvePreferences = append(c.CurvePreferences, id)
+	}
+
+	if len(t.Ciphers) > 0 && c.MinVersion == tls.VersionTLS13 {
+		return fmt.Errorf("ciphers have no effect with min_version 1.3")
+	}
+	for _, name := range t.Ciphers {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return err
+		}
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+	return nil
+}
+
+// 只接受安全的 TLS 1.2 加密套件, TLS 1.3 的套件不可配置
+func cipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+		for _, v := range cs.SupportedVersions {
+			if v != tls.VersionTLS13 {
+				return cs.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("cipher '%s' is TLS 1.3 only and not configurable", name)
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("cipher '%s' is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher '%s'", name)
+}
+
+// 读取吊销列表, 只接受由 client_ca 中的证书签发的
+func loadCRLs(files []string, caFile string) ([]*x509.RevocationList, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	cas, err := readCerts(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var crls []*x509.RevocationList
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if b, _ := pem.Decode(data); b != nil {
+			data = b.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+
+		signed := false
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, fmt.Errorf("%s: not signed by client_ca", f)
+		}
+		if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(time.Now()) {
+			logger.Warningf("CRL %s expired at %s", f, crl.NextUpdate)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+func readCerts(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+var errRevoked = errors.New("tls: client certificate revoked")
+
+// 校验通过的证书链中, 除根证书外任何一张被吊销都拒绝握手
+// 使用最近一次读取的吊销列表 (见 reloadLoop)
+func (t *ListenerTLSConf) checkRevoked(_ [][]byte, chains [][]*x509.Certificate) error {
+	crls := *t.crls.Load()
+	for _, chain := range chains {
+		for _, c := range chain[:len(chain)-1] {
+			for _, crl := range crls {
+				if !bytes.Equal(crl.RawIssuer, c.RawIssuer) {
+					continue
+				}
+				for _, e := range crl.RevokedCertificateEntries {
+					if e.SerialNumber.Cmp(c.SerialNumber) == 0 {
+						return errRevoked
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
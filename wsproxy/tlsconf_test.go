@@ -0,0 +1,82 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCRLReload(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(7), RawIssuer: ca.RawSubject}
+	crlFile := filepath.Join(dir, "ca.crl")
+	writeCRL := func(n int64, revoked ...int64) {
+		rl := &x509.RevocationList{Number: big.NewInt(n), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		for _, s := range revoked {
+			rl.RevokedCertificateEntries = append(rl.RevokedCertificateEntries,
+				x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+		}
+		b, err := x509.CreateRevocationList(rand.Reader, rl, ca, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(crlFile, b, 0600)
+	}
+
+	writeCRL(1)
+	tc := &ListenerTLSConf{Dev: true, ClientAuth: "require", ClientCA: caFile, CRL: []string{crlFile}, Reload: 60}
+	if err := tc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	chains := [][]*x509.Certificate{{leaf, ca}}
+	if err := tc.config.VerifyPeerCertificate(nil, chains); err != nil {
+		t.Fatalf("not yet revoked: %v", err)
+	}
+
+	//启动后发布的吊销
+	writeCRL(2, 7)
+	tc.reload("test")
+	if err := tc.config.VerifyPeerCertificate(nil, chains); err != errRevoked {
+		t.Fatalf("after reload err = %v, want revoked", err)
+	}
+
+	//读取失败时保留原来的列表
+	os.WriteFile(crlFile, []byte("garbage"), 0600)
+	tc.reload("test")
+	if err := tc.config.VerifyPeerCertificate(nil, chains); err != errRevoked {
+		t.Fatalf("after a bad reload err = %v, want revoked", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// 按 SNI 选择证书: 虚拟主机 > 证书目录 > cert (或开发证书) > 证书目录中的任意一个
+func (t *ListenerTLSConf) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c, err := vhostCertificate(hello); c != nil || err != nil {
+		return c, err
+	}
+	if t.dir != nil && hello.ServerName != "" {
+		if c := t.dir.get(hello.ServerName); c != nil {
+			return c, nil
+		}
+	}
+	if c := t.cert.Load(); c != nil {
+		return c, nil
+	}
+	if t.dir != nil {
+		return t.dir.get(""), nil
+	}
+	return nil, nil
+}
+
+// 读取证书与 OCSP 响应, 失败时保留原来的证书
+func (t *ListenerTLSConf) loadCert() error {
+	if t.Cert == "" {
+		if t.OCSPStaple != "" {
+			return fmt.Errorf("ocsp_staple requires cert")
+		}
+		return nil
+	}
+	key := t.Key
+	if key == "" {
+		key = t.Cert
+	}
+	c, err := tls.LoadX509KeyPair(t.Cert, key)
+	if err != nil {
+		return fmt.Errorf("cert: %s", err)
+	}
+
+	if t.OCSPStaple != "" {
+		der, err := os.ReadFile(t.OCSPStaple)
+		if err != nil {
+			return fmt.Errorf("ocsp_staple: %s", err)
+		}
+		// OCSPResponse 为 DER 编码的 SEQUENCE
+		if len(der) < 2 || der[0] != 0x30 {
+			return fmt.Errorf("ocsp_staple: %s is not a DER OCSP response", t.OCSPStaple)
+		}
+		c.OCSPStaple = der
+	}
+	t.cert.Store(&c)
+	return nil
+}
+
+// ************************************************************
+// session ticket 密钥文件, 每个文件一个32字节密钥,
+// 可以是原始字节、hex 或 base64 (openssl rand -base64 32)。
+// 第一个密钥用于加密, 其余只用于解密, 轮换时把新密钥放在前面。
+// ************************************************************
+func readTicketKeys(files []string) ([][32]byte, error) {
+	var keys [][32]byte
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var key [32]byte
+		if len(data) == 32 {
+			copy(key[:], data)
+			keys = append(keys, key)
+			continue
+		}
+
+		text := strings.TrimSpace(string(data))
+		b, err := hex.DecodeString(text)
+		if err != nil {
+			b, err = base64.StdEncoding.DecodeString(text)
+		}
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s: key must be 32 bytes", f)
+		}
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// 定期重新读取 ticket 密钥、OCSP 响应与吊销列表, 证书管理工具更新文件后无需重启
+func (t *ListenerTLSConf) reloadLoop(addr string) {
+	if t.Reload == 0 || len(t.TicketKeys) == 0 && t.OCSPStaple == "" && t.crls.Load() == nil {
+		return
+	}
+	for range time.Tick(time.Duration(t.Reload) * time.Second) {
+		t.reload(addr)
+	}
+}
+
+func (t *ListenerTLSConf) reload(addr string) {
+	if len(t.TicketKeys) > 0 {
+		if keys, err := readTicketKeys(t.TicketKeys); err != nil {
+			logger.Errorf("Reload ticket keys for %s: %s", addr, err)
+		} else {
+			//监听地址直接使用 t.config (见 l_https), 轮换立即生效
+			t.config.SetSessionTicketKeys(keys)
+		}
+	}
+	if t.OCSPStaple != "" {
+		if err := t.loadCert(); err != nil {
+			logger.Errorf("Reload certificate for %s: %s", addr, err)
+		}
+	}
+	//读取失败时继续使用原来的吊销列表
+	if t.crls.Load() != nil {
+		if crls, err := loadCRLs(t.CRL, t.ClientCA); err != nil {
+			logger.Errorf("Reload CRL for %s: %s", addr, err)
+		} else {
+			t.crls.Store(&crls)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ************************************************************
+// token 解码后的内容
+//
+// 兼容原来的格式, 解码后直接是后端地址:
+//
+//	10.0.0.1:9000
+//
+// 也可以是JSON, 附带声明 (claims), 转发给 websocket 后端时作为请求头部:
+//
+//	{"addr": "10.0.0.1:9000", "claims": {"uid": "42", "room": "7"}}
+//
+// 只有 AES 加密的 token 才转发 claims, 明文 token 中的 claims 被忽略
+//
+// /ws 路由可以用 url 指定完整的后端地址 (ws/wss、路径、参数):
+//
+//	{"url": "wss://chat.local/socket.io/?EIO=4&transport=websocket"}
+//
+// ************************************************************
+type tokenInfo struct {
+	Addr   string            `json:"addr"`
+	URL    string            `json:"url"`
+	Claims map[string]string `json:"claims"`
+}
+
+func parseToken(plain string) *tokenInfo {
+	//处理掉一些加密过程中的特殊字符, 如空格 \r\n
+	plain = strings.TrimSpace(plain)
+	if plain == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(plain, "{") {
+		t := &tokenInfo{}
+		if err := json.Unmarshal([]byte(plain), t); err != nil {
+			return nil
+		}
+		t.Addr = strings.TrimSpace(t.Addr)
+		if t.URL != "" {
+			addr, ok := urlAddr(t.URL)
+			if !ok {
+				return nil
+			}
+			t.Addr = addr
+		}
+		if t.Addr == "" {
+			return nil
+		}
+		return t
+	}
+	return &tokenInfo{Addr: plain}
+}
+
+// 从请求中取出token并解码, 无法解码时返回 nil
+// aes 为 true 时只接受加密的 token, secrets 依次用于解密
+func requestToken(r *http.Request, sid string, aes bool, secrets []string) *tokenInfo {
+	//收到加密串进行解码
+	var fromValueTrim string
+	fromValueTrim = strings.Replace(r.FormValue(cfgFormKey), " ", "+", -1)
+	encrypted := strings.TrimSpace(fromValueTrim)
+
+	//Token切割取样,某些时候可能会带?号,加上-fsplit可以用于切割
+	if cfgFormSplit != "" {
+		if strings.Contains(encrypted, cfgLfSplit) {
+			encrypted = strings.Split(encrypted, cfgLfSplit)[cfgRfSplit]
+		}
+	}
+
+	return decodeToken(encrypted, sid, aes, secrets)
+}
+
+// 解码一个 token (多路复用路由中每个流各自携带)
+func decodeToken(encrypted, sid string, aes bool, secrets []string) *tokenInfo {
+	//同时兼容加密与非加密token,也可强制使用加密
+	plain := tokenModel(aes, encrypted, sid, secrets)
+	if plain == "__CANTNOT_DECRYPT__" {
+		return nil
+	}
+	tk := parseToken(plain)
+	//明文 token 谁都可以构造, 其中的 claims 不转发给后端
+	if tk != nil && !aes && plainToken(encrypted) {
+		tk.Claims = nil
+	}
+	return tk
+}
+
+// ws/wss 地址中的 host:port, 未写端口时使用默认端口
+func urlAddr(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), "80"), true
+		}
+	case "wss":
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), "443"), true
+		}
+	default:
+		return "", false
+	}
+	return u.Host, true
+}
@@ -0,0 +1,305 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"context"
+	"crypto/aes256cbc"
+	"fmt"
+	"gorilla/websocket"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tcpserver "github.com/orkunkaraduman/go-tcpserver"
+)
+
+// ************************************************************
+// 反向隧道: 监听本地 TCP 端口, 每个连接拨号到远端 websocket
+//
+//	"tunnels": [
+//	  {"listen": "127.0.0.1:3306", "url": "wss://gw.example.com/",
+//	   "token": "10.0.0.5:3306", "aes": true, "ping": 30},
+//	  {"listen": "127.0.0.1:2222", "url": "ws://10.1.1.1:8080/ssh",
+//	   "headers": {"Authorization": "Bearer xxx"}}
+//	]
+//
+//	listen:   本地监听地址 host:port
+//	url:      远端 ws:// 或 wss:// 地址, 通常是另一个 wsproxy 的 TCP 路由
+//	token:    远端路由的 token (host:port 或 JSON), 以 -key 指定的参数名附加到 url;
+//	          远端路由为 "token": "none" 时不填
+//	aes:      用 secret 加密 token, secret 未配置时使用 -secret
+//	chain:    远端是级联的 wsproxy 时, token 改为签名的内层 token (见 chain.go),
+//	          客户端地址与会话ID随之传给远端
+//	headers:  握手请求附加的头部, 例如远端要求的认证头
+//	ping:     每隔多少秒发送 websocket ping, 3 个周期收不到 pong 时断开; 0 为不发送
+//	upstream/dial/retry: 与路由中的同名设置相同, 未配置时使用顶层设置
+//
+// 数据帧格式按 -stream, 与 TCP 路由一致; url 对应的 backends 设置
+// (TLS 校验、客户端证书) 同样生效。会话出现在 /sessions 中, 协议为 tunnel。
+// ************************************************************
+type TunnelConf struct {
+	Listen   string            `json:"listen"`
+	URL      string            `json:"url"`
+	Token    string            `json:"token"`
+	AES      bool              `json:"aes"`
+	Chain    bool              `json:"chain"`
+	Secret   string            `json:"secret"`
+	Headers  map[string]string `json:"headers"`
+	Ping     int               `json:"ping"`
+	Upstream *UpstreamConf     `json:"upstream"`
+	Dial     *DialConf         `json:"dial"`
+	Retry    *RetryConf        `json:"retry"`
+
+	addr string //url 中的 host:port, 用于查找 backends 设置与熔断
+}
+
+func (t *TunnelConf) compile() error {
+	if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+		return err
+	}
+	var ok bool
+	if t.addr, ok = urlAddr(t.URL); !ok {
+		return fmt.Errorf("url must be ws:// or wss://")
+	}
+	if t.Token != "" && !plainToken(t.Token) {
+		return fmt.Errorf("token must be host:port or JSON")
+	}
+	if (t.AES || t.Chain) && t.Token == "" {
+		return fmt.Errorf("aes/chain without token")
+	}
+	if t.AES && t.Chain {
+		return fmt.Errorf("aes and chain are exclusive")
+	}
+	if t.Ping < 0 {
+		return fmt.Errorf("ping must not be negative")
+	}
+	if t.Upstream != nil {
+		if err := t.Upstream.compile(); err != nil {
+			return fmt.Errorf("upstream: %s", err)
+		}
+	}
+	if t.Dial != nil {
+		if err := t.Dial.compile(); err != nil {
+			return fmt.Errorf("dial: %s", err)
+		}
+	}
+	if t.Retry != nil {
+		if err := t.Retry.compile(); err != nil {
+			return fmt.Errorf("retry: %s", err)
+		}
+	}
+	return nil
+}
+
+func (t *TunnelConf) String() string {
+	return t.Listen + " -> " + t.URL
+}
+
+// 未配置时使用顶层设置, 与路由相同
+func (t *TunnelConf) upstream() *UpstreamConf {
+	if t.Upstream != nil {
+		return t.Upstream
+	}
+	return cfg.Upstream
+}
+
+func (t *TunnelConf) dialConf() *DialConf {
+	if t.Dial != nil {
+		return t.Dial
+	}
+	if cfg.Dial != nil {
+		return cfg.Dial
+	}
+	return defaultDial
+}
+
+func (t *TunnelConf) retry() *RetryConf {
+	if t.Retry != nil {
+		return t.Retry
+	}
+	if cfg.Retry != nil {
+		return cfg.Retry
+	}
+	return defaultRetry
+}
+
+// 握手地址与头部, token 按需加密或签名后附加到查询参数
+func (t *TunnelConf) request(sid string, client net.Addr) (string, http.Header, error) {
+	header := http.Header{}
+	for k, v := range t.Headers {
+		header.Set(k, v)
+	}
+	if t.Token == "" {
+		return t.URL, header, nil
+	}
+
+	token := t.Token
+	if t.AES {
+		var err error
+		secret := If(t.Secret != "", t.Secret, cfgSecret).(string)
+		if token, err = aes256cbc.EncryptString(secret, token); err != nil {
+			return "", nil, fmt.Errorf("encrypt token: %s", err)
+		}
+	}
+	if t.Chain {
+		var ch http.Header
+		ip, port := tcpAddrOf(client)
+		token, ch = cfg.Chain.outbound(parseToken(t.Token), sid, ip, port, nil)
+		for k, vs := range ch {
+			header[k] = vs
+		}
+	}
+	u, err := withTokenParam(t.URL, token)
+	return u, header, err
+}
+
+func tcpAddrOf(a net.Addr) (net.IP, int) {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		return ta.IP, ta.Port
+	}
+	return nil, 0
+}
+
+// 连接远端 websocket, 失败时按 retry 重试
+func (t *TunnelConf) dial(sid string, client net.Addr, since time.Time) (*websocket.Conn, error) {
+	u, header, err := t.request(sid, client)
+	if err != nil {
+		return nil, err
+	}
+	d := findBackend(t.addr).wsDialer(t.dialConf())
+	if up := t.upstream(); up != nil {
+		d.Proxy = up.wsProxy
+	}
+	if t.Chain {
+		ip, port := tcpAddrOf(client)
+		chainDialer(d, t.upstream().proxyFor(t.addr), ip, port, sid)
+	}
+
+	var wc *websocket.Conn
+	ctx, cancel := dialBudget(since)
+	defer cancel()
+	tries := 0
+	err = t.retry().run(ctx, t.addr, func(ctx context.Context) (err error) {
+		//chain 的内层 token 只能使用一次, 重试时重新生成 (第一次已成功生成过)
+		if tries++; tries > 1 && t.Chain {
+			u, header, _ = t.request(sid, client)
+		}
+		var resp *http.Response
+		wc, resp, err = d.DialContext(ctx, u, header)
+		if err == websocket.ErrBadHandshake && resp != nil {
+			err = fmt.Errorf("%w: %s", err, resp.Status)
+		}
+		return err
+	})
+	return wc, err
+}
+
+// tcpserver.Handler, 连接在 Serve 返回后由 tcpserver 关闭
+func (t *TunnelConf) Serve(conn net.Conn, closeCh <-chan struct{}) {
+	var _t = time.Now()
+	var _h = newSessionID()
+	var remote = conn.RemoteAddr().String()
+
+	if !sessions.reserve(max_connections) {
+		logger.Warningf("Tunnel %s: too many connections, %s, Session-Id:%s", t, remote, _h)
+		return
+	}
+	wc, err := t.dial(_h, conn.RemoteAddr(), _t)
+	if err != nil {
+		sessions.unreserve()
+		logger.Errorf("Tunnel %s: %s, %s, %s, Session-Id:%s", t, err, remote, time.Since(_t), _h)
+		return
+	}
+	logger.Infof("Tunnel %s: connected, %s, %s, Session-Id:%s", t, remote, time.Since(_t), _h)
+
+	p := &p_worker{key: _h, format: streamFormat(), ws: wc, sock: conn,
+		proto: "tunnel", raddr: t.URL, remote: remote, since: _t}
+	done := make(chan struct{})
+	if t.Ping > 0 {
+		p.keepalive(time.Duration(t.Ping)*time.Second, done)
+	}
+	sessions.add(p)
+	p.start("tcp")
+	go func() {
+		p.wait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-closeCh:
+		//网关退出
+		p.abort()
+		<-done
+	}
+	logger.Infof("Tunnel %s: closed, %s, %s, Session-Id:%s", t, remote, time.Since(_t), _h)
+}
+
+// 定时发送 ping, 远端长时间没有 pong 时断开 (中间设备静默丢弃连接的情况)
+func (p *p_worker) keepalive(interval time.Duration, done <-chan struct{}) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	//须在开始读取之前设置
+	p.ws.SetPongHandler(func(string) error {
+		last.Store(time.Now().UnixNano())
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if time.Since(time.Unix(0, last.Load())) > 3*interval {
+				logger.Warningf("Tunnel ping timeout, Session-Id:%s", p.key)
+				p.abort()
+				return
+			}
+			if err := p.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// 启动所有隧道的监听, 失败时退出
+func serveTunnels(tunnels []*TunnelConf) []*tcpserver.TCPServer {
+	var srvs []*tcpserver.TCPServer
+	for _, t := range tunnels {
+		ln, err := net.Listen("tcp", t.Listen)
+		if err != nil {
+			fmt.Println("")
+			fmt.Printf("Tunnel Listen Err: \"%s\"\n", err.Error())
+			CloseSignal()
+			continue
+		}
+		srv := &tcpserver.TCPServer{Addr: t.Listen, Handler: t}
+		go srv.Serve(ln)
+		srvs = append(srvs, srv)
+	}
+	return srvs
+}
+
+// 启动信息中的隧道列表
+func tunnelInfo(tunnels []*TunnelConf) string {
+	if len(tunnels) == 0 {
+		return "-"
+	}
+	var s []string
+	for _, t := range tunnels {
+		s = append(s, t.String())
+	}
+	return strings.Join(s, ", ")
+}
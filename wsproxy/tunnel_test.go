@@ -0,0 +1,165 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/aes256cbc"
+	"gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 远端 websocket, 每个连接交给 serve 处理, 返回 ws:// 地址与收到的握手请求
+func tunnelEndpoint(t *testing.T, serve func(ws *websocket.Conn)) (string, <-chan *http.Request) {
+	reqs := make(chan *http.Request, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		reqs <- r
+		serve(ws)
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/", reqs
+}
+
+// 原样发回收到的消息
+func echoWS(ws *websocket.Conn) {
+	for {
+		mt, b, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.WriteMessage(mt, b)
+	}
+}
+
+// 在本地端口上运行隧道, 返回一个已连接的 TCP 客户端
+func dialTunnel(t *testing.T, tc *TunnelConf) net.Conn {
+	saved := cfgDialTimeout
+	cfgDialTimeout = uint(3 * time.Second)
+	tc.Listen = "127.0.0.1:0"
+	if err := tc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", tc.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeCh := make(chan struct{})
+	t.Cleanup(func() {
+		ln.Close()
+		close(closeCh)
+		cfgDialTimeout = saved
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tc.Serve(c, closeCh)
+				c.Close()
+			}()
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func tunnelEcho(t *testing.T, c net.Conn) {
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("echo = %q, %v", b, err)
+	}
+}
+
+func TestTunnelToken(t *testing.T) {
+	u, reqs := tunnelEndpoint(t, echoWS)
+	c := dialTunnel(t, &TunnelConf{URL: u, Token: "10.0.0.5:3306",
+		Headers: map[string]string{"Authorization": "Bearer xxx"}})
+	tunnelEcho(t, c)
+
+	r := <-reqs
+	if tk := r.FormValue(cfgFormKey); tk != "10.0.0.5:3306" {
+		t.Fatalf("token = %q", tk)
+	}
+	if a := r.Header.Get("Authorization"); a != "Bearer xxx" {
+		t.Fatalf("Authorization = %q", a)
+	}
+}
+
+func TestTunnelAESToken(t *testing.T) {
+	u, reqs := tunnelEndpoint(t, echoWS)
+	c := dialTunnel(t, &TunnelConf{URL: u, Token: `{"addr": "10.0.0.5:3306"}`, AES: true, Secret: "tunnel-secret"})
+	tunnelEcho(t, c)
+
+	enc := strings.Replace((<-reqs).FormValue(cfgFormKey), " ", "+", -1)
+	if plainToken(enc) {
+		t.Fatalf("token sent in plain text: %q", enc)
+	}
+	if p, err := aes256cbc.DecryptString("tunnel-secret", enc); err != nil || p != `{"addr": "10.0.0.5:3306"}` {
+		t.Fatalf("decrypted token = %q, %v", p, err)
+	}
+}
+
+func TestTunnelChainToken(t *testing.T) {
+	saved := cfg.Chain
+	defer func() { cfg.Chain = saved }()
+	cfg.Chain = chainTestConf(t, "edge")
+
+	u, reqs := tunnelEndpoint(t, echoWS)
+	c := dialTunnel(t, &TunnelConf{URL: u, Token: "10.0.0.5:3306", Chain: true})
+	tunnelEcho(t, c)
+
+	//以下一跳的身份校验内层 token
+	r := <-reqs
+	cfg.Chain = chainTestConf(t, "inner")
+	h, err := chainHopFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.token.Addr != "10.0.0.5:3306" || !h.ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("hop = %+v", h)
+	}
+}
+
+func TestTunnelPingTimeout(t *testing.T) {
+	//不读取就不会回复 pong
+	hold := make(chan struct{})
+	defer close(hold)
+	u, _ := tunnelEndpoint(t, func(ws *websocket.Conn) {
+		<-hold
+	})
+	c := dialTunnel(t, &TunnelConf{URL: u, Ping: 1})
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read err = %v, want EOF after ping timeout", err)
+	}
+	if d := time.Since(start); d < 3*time.Second {
+		t.Fatalf("closed after %v, before 3 ping intervals", d)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 The WebSocket Proxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// @Author: YWJT / ZhiQiang Koo
+// @Modify: 2026-10-19
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ************************************************************
+// 虚拟主机, 按 TLS SNI 与 HTTP Host 选择
+//
+//	"vhosts": [
+//	  {"hosts": ["game.example.com", "*.game.example.com"],
+//	   "cert": "game.pem", "key": "game.key",
+//	   "secrets": ["new-passphrase", "old-passphrase"],
+//	   "allow": ["10.1.0.0/16", "game.local:9000"],
+//	   "max_conns": 10000,
+//	   "routes": [{"path": "/", "proto": "tcp"}]}
+//	]
+//
+//	hosts:     主机名, *.example.com 匹配其子域名
+//	cert/key:  该主机名使用的证书, SNI 命中时提供, 未配置时使用 -ssl_cert
+//	secrets:   解密 token 的密钥, 依次尝试 (用于轮换), 未配置时使用 -secret
+//	allow:     允许连接的后端地址, 写法同 backends 的 match, 未配置时不限制
+//	max_conns: 本主机的最大连接数, 0 为不单独限制
+//	routes:    本主机的路由表, 未配置时使用全局路由表
+//
+// SNI 与 Host 指向不同的虚拟主机时返回 421, 防止借用其他主机的证书访问。
+// 都未命中时使用全局配置。
+// ************************************************************
+type VHostConf struct {
+	Hosts    []string     `json:"hosts"`
+	Cert     string       `json:"cert"`
+	Key      string       `json:"key"`
+	Secrets  []string     `json:"secrets"`
+	Allow    []string     `json:"allow"`
+	MaxConns int64        `json:"max_conns"`
+	Routes   []*RouteConf `json:"routes"`
+
+	cert  *tls.Certificate
+	allow []func(host, port string) bool
+	conns int64
+}
+
+func (vh *VHostConf) compile(groups map[string]*GroupConf) error {
+	if len(vh.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	for i, h := range vh.Hosts {
+		vh.Hosts[i] = strings.ToLower(strings.TrimSpace(h))
+	}
+
+	if vh.Cert != "" {
+		key := vh.Key
+		if key == "" {
+			key = vh.Cert
+		}
+		c, err := tls.LoadX509KeyPair(vh.Cert, key)
+		if err != nil {
+			return fmt.Errorf("cert: %s", err)
+		}
+		vh.cert = &c
+	}
+
+	vh.allow = nil
+	for _, m := range vh.Allow {
+		f, err := hostMatcher(m)
+		if err != nil {
+			return fmt.Errorf("allow: %s", err)
+		}
+		vh.allow = append(vh.allow, f)
+	}
+
+	if vh.MaxConns < 0 {
+		return fmt.Errorf("invalid max_conns %d", vh.MaxConns)
+	}
+
+	for _, rt := range vh.Routes {
+		if err := rt.compile(groups); err != nil {
+			return fmt.Errorf("routes %s: %s", rt.Path, err)
+		}
+	}
+	return nil
+}
+
+func (vh *VHostConf) matches(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, h := range vh.Hosts {
+		if h == name {
+			return true
+		}
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(name, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func findVHost(name string) *VHostConf {
+	if name == "" {
+		return nil
+	}
+	for _, vh := range cfg.VHosts {
+		if vh.matches(name) {
+			return vh
+		}
+	}
+	return nil
+}
+
+// 请求所属的虚拟主机, SNI 与 Host 不一致时 ok 为 false
+func vhostFor(r *http.Request) (vh *VHostConf, ok bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	vh = findVHost(host)
+	if r.TLS != nil && r.TLS.ServerName != "" && findVHost(r.TLS.ServerName) != vh {
+		return nil, false
+	}
+	return vh, true
+}
+
+// tls.Config.GetCertificate, 未命中时返回 nil 使用默认证书
+func vhostCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if vh := findVHost(hello.ServerName); vh != nil && vh.cert != nil {
+		return vh.cert, nil
+	}
+	return nil, nil
+}
+
+func (vh *VHostConf) routeTable() []*RouteConf {
+	if vh != nil && len(vh.Routes) > 0 {
+		return vh.Routes
+	}
+	return routeTable()
+}
+
+func (vh *VHostConf) secrets() []string {
+	if vh != nil && len(vh.Secrets) > 0 {
+		return vh.Secrets
+	}
+	return []string{cfgSecret}
+}
+
+// 后端地址是否在白名单内
+func (vh *VHostConf) allowed(raddr string) bool {
+	if vh == nil || len(vh.allow) == 0 {
+		return true
+	}
+	host, port, err := net.SplitHostPort(raddr)
+	if err != nil {
+		host = raddr
+	}
+	for _, f := range vh.allow {
+		if f(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 占用本主机的一个连接名额
+func (vh *VHostConf) reserve() bool {
+	if vh == nil || vh.MaxConns == 0 {
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(&vh.conns)
+		if n >= vh.MaxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&vh.conns, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (vh *VHostConf) unreserve() {
+	if vh != nil && vh.MaxConns > 0 {
+		atomic.AddInt64(&vh.conns, -1)
+	}
+}
@@ -14,6 +14,7 @@ import (
     "flag"
     "strconv"
     "regexp"
+    "os"
     "github.com/google/uuid"
 )
 
@@ -27,14 +28,23 @@ var (
     
     cfgGatewayAddr = "0.0.0.0:1443"
     cfgDialTimeout = uint(3)
+    cfgDrainTimeout = uint(10)
     cfgBufferSize  = uint(1 * 1024)
     cfgMaxConns    = uint(64 * 1024)
     cfgBuffFormat  = "bin"  // {bin, text}
     cfgFormSplit   = ""
     cfgFormKey     = "token"
+    cfgPPVersion   = uint(1)
+    cfgAcceptPP    = ""
+    cfgTrusted     = ""
+    cfgRealIP      = ""
+    cfgSubproto    = ""
     
+    cfgConfFile  = ""
     cfgCertFile  = "./cert.pem"
     cfgKeyFile   = "./key.pem"
+    cfgCertDir   = ""
+    sslDev      = true
     appVersion  = true
     sslOnly     = true
     aesOnly     = true
@@ -48,37 +58,52 @@ func version() {
     fmt.Printf("WSproxy v%s\n", __VERSION__)
 }
 
+var flagSecret string
+
 func init() {
 
     // Help flag list
-    var secret string
-	flag.StringVar(&secret, "secret", "", "The passphrase used to decrypt target server address")
+	flag.StringVar(&flagSecret, "secret", "", "The passphrase used to decrypt target server address")
 	flag.StringVar(&cfgGatewayAddr, "addr", cfgGatewayAddr, "Network address for gateway")
 	flag.UintVar(&cfgDialTimeout, "timeout", cfgDialTimeout, "Timeout seconds when dial to targer server")
+    flag.UintVar(&cfgDrainTimeout, "drain_timeout", cfgDrainTimeout, "Timeout seconds to drain the other direction after one side half-closed")
     flag.UintVar(&cfgBufferSize, "buffer", cfgBufferSize, "Buffer size for ReadBuffer()/WriteBuffer()")
     flag.UintVar(&cfgMaxConns, "max_conns", cfgMaxConns, "Max connections to slots available.")
     flag.StringVar(&cfgBuffFormat, "stream", cfgBuffFormat, "Buffer stream format for (text, bin). Only TCP/UDP backend.\n(Exp: -stream bin or -stream text )")
     flag.StringVar(&cfgFormSplit, "fsplit", cfgFormSplit, "Split token from formValue, like '?t=xeR7LpmprJS8U...?v=4693225'\n(Exp: -fsplit \"?v=\",0 )  Res: 'xeR7LpmprJS8U...' ")
     flag.StringVar(&cfgFormKey, "frkey", cfgFormKey, "Key name for URL request. like '/?token=xeR7LpmprJS8U...'\n(Exp: -frkey token or -frkey token123) Fmt: ^[a-z]+[0-9]* ")
+    flag.StringVar(&cfgConfFile, "conf", cfgConfFile, "Config file (JSON) for extended settings, like close_codes")
     flag.StringVar(&cfgCertFile, "ssl_cert", cfgCertFile, "SSL certificate file")
 	flag.StringVar(&cfgKeyFile, "ssl_key", cfgKeyFile, "SSL key file (if separate from cert)")
     flag.BoolVar(&sslOnly, "ssl_only", false, "Run WSproxy for TLS version")
+    flag.StringVar(&cfgCertDir, "ssl_cert_dir", cfgCertDir, "Certificate directory, certificates are chosen by SNI and reloaded when files change")
+    flag.BoolVar(&sslDev, "ssl_dev", false, "Use a cached self-signed certificate with -ssl_only, for development only")
     flag.BoolVar(&aesOnly, "aes_only", false, "Run WSproxy on encryption mode for AES")
     flag.BoolVar(&PProto, "proxyproto", false, "Enable proxy protocol mode, Requires backend server support")
+    flag.UintVar(&cfgPPVersion, "pp_version", cfgPPVersion, "Proxy protocol version (1 or 2) used with -proxyproto, can be overridden per backend in -conf")
+    flag.StringVar(&cfgAcceptPP, "accept_proxyproto", cfgAcceptPP, "Accept proxy protocol header on gateway listener from these trusted CIDRs\n(Exp: -accept_proxyproto 10.0.0.0/8,192.168.1.10 )")
+    flag.StringVar(&cfgTrusted, "trusted_proxies", cfgTrusted, "Trusted proxy CIDRs, only their -real_ip_header is used\n(Exp: -trusted_proxies 10.0.0.0/8,127.0.0.1 )")
+    flag.StringVar(&cfgRealIP, "real_ip_header", cfgRealIP, "The only header read from trusted proxies for the client address, default X-Forwarded-For\n(Exp: -real_ip_header X-Real-IP )")
+    flag.StringVar(&cfgSubproto, "subprotocols", cfgSubproto, "Allowed websocket subprotocols for TCP/UDP backend, in order of preference\n(Exp: -subprotocols mqtt,v12.stomp )")
     flag.BoolVar(&appVersion, "version", false, "Print WSproxy version")
-    
+}
+
+// 在 main 中解析参数, go test 的参数不会被当作未定义的参数
+func parseFlags() {
 	flag.Parse()
-    cfgSecret = string(secret)
+    cfgSecret = string(flagSecret)
 	cfgDialTimeout = uint(time.Second) * cfgDialTimeout
+    cfgDrainTimeout = uint(time.Second) * cfgDrainTimeout
     cfgFormSplit = strings.Replace(cfgFormSplit, " ", "", -1)
     cfgFormKey = strings.TrimSpace(cfgFormKey)
     cfgFormKey = strings.ToLower(cfgFormKey)
     cfgBuffFormat = strings.ToLower(cfgBuffFormat)
     __SSL_TLS__ = If(sslOnly==true, "support", __SSL_TLS__).(string)
-    __PPROTO__ = If(PProto==true, "enable", __PPROTO__).(string)
+    __PPROTO__ = If(PProto==true, fmt.Sprintf("enable (v%d)", cfgPPVersion), __PPROTO__).(string)
 }
 
 func main() {
+    parseFlags()
 
     if appVersion == true {
        version()
@@ -91,6 +116,44 @@ func main() {
 		return
 	}
     
+    if cfgConfFile != "" {
+        if err := loadConfig(cfgConfFile); err != nil {
+            fmt.Printf("Config file error: %s\n\n", err)
+            return
+        }
+    }
+
+    if cfgAcceptPP != "" {
+        if cfg.AcceptPP == nil {
+            cfg.AcceptPP = &AcceptPPConf{}
+        }
+        cfg.AcceptPP.Use = append(cfg.AcceptPP.Use, strings.Split(cfgAcceptPP, ",")...)
+        if err := cfg.AcceptPP.compile(); err != nil {
+            fmt.Printf("Missing passphrase, maybe '-accept_proxyproto' format error. %s\n\n", err)
+            return
+        }
+    }
+
+    if cfgTrusted != "" {
+        nets, err := parseCIDRs(strings.Split(cfgTrusted, ","))
+        if err != nil {
+            fmt.Printf("Missing passphrase, maybe '-trusted_proxies' format error. %s\n\n", err)
+            return
+        }
+        trustedProxies = append(trustedProxies, nets...)
+    }
+    if cfgRealIP != "" {
+        realIPHeader = cfgRealIP
+    }
+
+    if cfgSubproto != "" {
+        for _, p := range strings.Split(cfgSubproto, ",") {
+            if p = strings.TrimSpace(p); p != "" {
+                staticSubprotocols = append(staticSubprotocols, p)
+            }
+        }
+    }
+
     if cfgFormSplit != "" {
         if len(strings.Split(cfgFormSplit, ",")) == 2 {
             cfgLfSplit = strings.Split(cfgFormSplit, ",")[0]
@@ -112,6 +175,11 @@ func main() {
         return
     }
     
+    if cfgPPVersion != 1 && cfgPPVersion != 2 {
+        fmt.Printf("Missing passphrase, '-pp_version %d' No support.\n", cfgPPVersion)
+        return
+    }
+
     if cfgBuffFormat != "bin" && cfgBuffFormat != "text" {
         fmt.Printf("Missing passphrase, '-stream %s' No support.\n", cfgBuffFormat)
         return
@@ -120,14 +188,42 @@ func main() {
     //set max connectionns
     setMaxConns(int(cfgMaxConns))
 
+    //未配置 listeners 时按 -addr 与 -ssl_only 监听
+    listeners := cfg.Listeners
+    if len(listeners) == 0 {
+        l := &ListenerConf{Addr: cfgGatewayAddr}
+        if sslOnly {
+            l.TLS = &ListenerTLSConf{Cert: cfgCertFile, Key: cfgKeyFile, CertDir: cfgCertDir, Dev: sslDev}
+            // 开发模式, 或者只用证书目录且没有默认证书文件时, 不读取 -ssl_cert
+            if _, err := os.Stat(cfgCertFile); sslDev || cfgCertDir != "" && err != nil {
+                l.TLS.Cert, l.TLS.Key = "", ""
+            }
+        }
+        if err := l.compile(); err != nil {
+            fmt.Printf("Missing passphrase, maybe '-addr' or '-ssl_cert' error. %s\n\n", err)
+            return
+        }
+        listeners = append(listeners, l)
+    }
+    var addrs []string
+    for _, l := range listeners {
+        addrs = append(addrs, l.String())
+        if l.TLS != nil {
+            __SSL_TLS__ = "support"
+        }
+    }
+
     pid := NewSignal()
     runInfo := fmt.Sprintf(`============= WSproxy running: OK , [%v] =============
 UUID:          %s
 Version:       %s
 Address:       %s
+Admin:         %s
+Tunnels:       %s
 SSL/TLS:       %s
 Proxy Proto:   %s
 Dial Timeout:  %s
+Drain Timeout: %s
 Max Connects:  %d
 Buffer Size:   %d
 Passphrase:    %s
@@ -138,10 +234,13 @@ Process ID:    %d
         time.Unix(time.Now().Unix(), 0),
         serverUUID,
         __VERSION__,
-        cfgGatewayAddr,
+        strings.Join(addrs, ", "),
+        If(cfg.Admin == "", "-", cfg.Admin).(string),
+        tunnelInfo(cfg.Tunnels),
         __SSL_TLS__,
         __PPROTO__,
         time.Duration(cfgDialTimeout),
+        time.Duration(cfgDrainTimeout),
         cfgMaxConns,
         cfgBufferSize,
         cfgSecret,
@@ -151,10 +250,9 @@ Process ID:    %d
     logger.Flush()
     
     //runtime.GOMAXPROCS(runtime.NumCPU())
-    NewServer(cfgGatewayAddr, 
-              cfgCertFile, 
-               cfgKeyFile, 
-                  sslOnly, 
+    NewServer(listeners, 
+              cfg.Admin, 
+              cfg.Tunnels,
                   runInfo).start()
     
 }